@@ -2,13 +2,16 @@ package app
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
@@ -17,25 +20,41 @@ import (
 	"github.com/BRUHItsABunny/gOkHttp/client"
 	"github.com/BRUHItsABunny/go-premiumize/api"
 	premiumize_client "github.com/BRUHItsABunny/go-premiumize/client"
+	"github.com/dustin/go-humanize"
 )
 
 type App struct {
 	Cfg            *Config
 	Client         *premiumize_client.PremiumizeClient
-	DownloadClient *http.Client
+	HTTPClient     *http.Client // for API calls
+	DownloadClient *http.Client // for file transfers, fails on expired links
+	Limiter        *utils.RateLimiter
+	RateSchedule   *utils.RateSchedule
 	BLog           *bunnlog.BunnyLog
 	Stats          *gokhttp_download.GlobalDownloadTracker
-	Directory      *utils.PDirectory
+	Selector       *utils.Selector
+	Jobs           []*SyncJob
+	Shutdown       *Shutdown
+	Control        *Control
+	Metrics        *Metrics
+	Events         *Events // nil unless -daemon
+	Hooks          *Hooks
+	LogPath        string // the log file of this run
+
+	statsMu sync.RWMutex // held by ResetStats so the API never copies a half reset tracker
 }
 
 func NewApp() (*App, error) {
-	app := &App{}
+	app := &App{Metrics: NewMetrics()}
 
-	// CLI args to struct
-	app.ParseCfg()
+	// CLI args, env and config file to struct
+	err := app.ParseCfg()
+	if err != nil {
+		return nil, err
+	}
 
 	// Logger
-	err := app.SetupLogger()
+	err = app.SetupLogger()
 	if err != nil {
 		return nil, err
 	}
@@ -52,46 +71,129 @@ func NewApp() (*App, error) {
 		return nil, err
 	}
 
+	// Folders to sync
+	err = app.SetupJobs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Crawl filters
+	err = app.SetupFilter()
+	if err != nil {
+		return nil, err
+	}
+
 	app.Stats = gokhttp_download.NewGlobalDownloadTracker(time.Duration(app.Cfg.ProgressTimeOut) * time.Second)
 	app.Stats.PollIP(app.DownloadClient)
 
+	// SIGINT and SIGTERM
+	app.Shutdown = NewShutdown(app.BLog)
+	app.Control = NewControl(app.Cfg.DownloadThreads)
+	if app.Cfg.Daemon {
+		app.Events = NewEvents(os.Stdout)
+	}
+	app.Hooks, err = NewHooks(app.Cfg, app.BLog)
+	if err != nil {
+		return nil, fmt.Errorf("NewHooks: %w", err)
+	}
+
 	return app, err
 }
 
-func (a *App) ParseCfg() {
+func (a *App) ParseCfg() error {
 	if a.Cfg == nil {
 		a.Cfg = &Config{}
 	}
 
+	err := utils.LoadEnv()
+	if err != nil {
+		return fmt.Errorf("utils.LoadEnv: %w", err)
+	}
+	flag.StringVar(&a.Cfg.ConfigPath, "config", os.Getenv(EnvName("config")), "This argument is the location of a YAML config file with the same settings as the flags, flags and "+EnvPrefix+"* env variables take precedence over it")
+	flag.StringVar(&a.Cfg.Profile, "profile", os.Getenv(EnvName("profile")), "This argument is the name of the profile in the config file to use on top of its top level settings")
+
 	flag.StringVar(&a.Cfg.APIKey, "apikey", "", "This is our APIKey - not needed and can also be set as env variable PREMIUMIZE_API_KEY, if missing it will authenticate via device code")
 	flag.IntVar(&a.Cfg.DownloadThreads, "threads", 1, "This is how many files we download in parallel (min=1, max=9)")
-	flag.StringVar(&a.Cfg.Folder, "folder", "", "This is the folder we will start crawling in")
+	flag.Var(&a.Cfg.Folders, "folder", "This is the folder we will start crawling in, can be repeated as src=dest to sync several folders into their own local folder (split on the first =)")
 	flag.BoolVar(&a.Cfg.Recursive, "recursion", false, "This controls if we want all files inside all folders of the folder you selected or just all files in the folder you selected")
+	flag.IntVar(&a.Cfg.Depth, "depth", 0, "This argument limits how many levels of folders are crawled with -recursion, 1 is only the folder you selected and 0 is unlimited")
 	flag.IntVar(&a.Cfg.ProgressTimeOut, "ptimeout", 5, "This is how many seconds we wait for any progress update before we assume we are done")
 	flag.StringVar(&a.Cfg.Proxy, "proxy", "", "This argument is for proxying this program (format: proto://ip:port)")
 	flag.BoolVar(&a.Cfg.Debug, "debug", false, "This argument is for how verbose the logger will be")
-	flag.BoolVar(&a.Cfg.Daemon, "daemon", false, "This argument is for how the UI feedback will be, if set to true it will print JSON")
+	flag.BoolVar(&a.Cfg.Daemon, "daemon", false, "This argument is for how the UI feedback will be, if set to true it will print versioned NDJSON events (see the README) instead")
 	flag.BoolVar(&a.Cfg.Version, "version", false, "This argument will print the current version data and exit")
 	flag.BoolVar(&a.Cfg.IgnoreParallel, "ignoreparallel", false, "This argument is used to override parallel run detection if set to true")
+	flag.DurationVar(&a.Cfg.LockTimeout, "lock-timeout", 0, "This argument is how long we wait for another sync of the same folder to finish (eg: 10m), by default we exit right away")
 	flag.StringVar(&a.Cfg.LogName, "logname", "premiumize-file-sync-:UNIX_TIME.log", "This argument is for specifying the log file name. Default: premiumize-file-sync.log")
 	flag.BoolVar(&a.Cfg.OutputAnalysis, "analyze", false, "This argument is used to output a detailed analysis of the files and folders that are relevant to the run prior to downloading anything")
-	flag.BoolVar(&a.Cfg.Repair, "repair", false, "This argument is used to repair the local files and folders that are relevant to the run (eg: when you're downloading more than what's possible) by deleting the file and letting the program redownload it")
+	flag.BoolVar(&a.Cfg.Repair, "repair", false, "This argument is used to repair the local files and folders that are relevant to the run by resuming partial files and deleting oversized files so the program can redownload them")
+	flag.StringVar(&a.Cfg.StatePath, "state", "", "This argument is for specifying the location of the sync state file, defaults to "+utils.DefaultStateName+" inside the local copy of the synced folder")
+	flag.BoolVar(&a.Cfg.RebuildState, "rebuildstate", false, "This argument is used to rebuild the sync state from the files that are already on disk before syncing")
+	flag.BoolVar(&a.Cfg.Force, "force", false, "This argument is used to redownload every file, even the ones that are already complete on disk")
+	flag.BoolVar(&a.Cfg.Mirror, "mirror", false, "This argument is used to remove local files and empty folders that no longer exist on the cloud after a successful sync")
+	flag.BoolVar(&a.Cfg.DryRun, "dry-run", false, "This argument is used to only print what -mirror and -move would remove")
+	flag.IntVar(&a.Cfg.MaxDeletions, "max-deletions", 100, "This argument is the maximum amount of files -mirror may remove before it refuses to remove anything (0 = no limit)")
+	flag.StringVar(&a.Cfg.TrashDir, "trash", "", "This argument is for moving files removed by -mirror into this folder instead of deleting them, it must be outside the synced folders")
+	flag.StringVar(&a.Cfg.Format, "format", utils.ReportFormatTable, "This argument is for the output format of -analyze (table, json or csv)")
+	flag.IntVar(&a.Cfg.Retries, "retries", 3, "This argument is how many times a failed download is retried before we give up on that file")
+	flag.IntVar(&a.Cfg.RetryDelay, "retry-delay", 5, "This argument is how many seconds we wait before the first retry, the wait doubles with every retry")
+	flag.BoolVar(&a.Cfg.Verify, "verify", false, "This argument is used to rehash the synced files and compare them against the hashes recorded in the sync state")
+	flag.BoolVar(&a.Cfg.Requeue, "requeue", false, "This argument is used together with -verify to delete corrupted files and download them again")
+	flag.StringVar(&a.Cfg.Dest, "dest", ".", "This argument is the local folder the synced folder is stored in")
+	flag.BoolVar(&a.Cfg.StripRoot, "strip-root", false, "This argument is used to store the content of the synced folder directly in -dest instead of in a subfolder named after it")
+	flag.Var(&a.Cfg.Include, "include", "This argument is a pattern for the files to sync, can be repeated (glob on the relative path, re:REGEX or ext:mkv,mp4)")
+	flag.Var(&a.Cfg.Exclude, "exclude", "This argument is a pattern for the files and folders to leave out, can be repeated (glob on the relative path, re:REGEX or ext:mkv,mp4)")
+	flag.StringVar(&a.Cfg.MinSize, "min-size", "", "This argument is the minimum size of the files to download, eg: 50MB")
+	flag.StringVar(&a.Cfg.MaxSize, "max-size", "", "This argument is the maximum size of the files to download, eg: 10GB")
+	flag.StringVar(&a.Cfg.NewerThan, "newer-than", "", "This argument is for only downloading files added to the cloud within this time, eg: 24h or 7d")
+	flag.StringVar(&a.Cfg.OlderThan, "older-than", "", "This argument is for only downloading files added to the cloud longer than this time ago, eg: 24h or 7d")
+	flag.DurationVar(&a.Cfg.Watch, "watch", 0, "This argument turns on watch mode, the folders are crawled again after this interval (eg: 15m) and new files are downloaded until the program receives SIGINT or SIGTERM")
+	flag.DurationVar(&a.Cfg.WatchJitter, "watch-jitter", 0, "This argument is the maximum random time added to or taken from the -watch interval, defaults to a tenth of the interval")
+	flag.StringVar(&a.Cfg.HealthPath, "health", "", "This argument is the location of a JSON health file that is rewritten every few seconds in watch mode, for supervisors")
+	flag.StringVar(&a.Cfg.LimitRate, "limit-rate", "", "This argument is the maximum download speed of all downloads together, eg: 20MB/s")
+	flag.StringVar(&a.Cfg.LimitSchedule, "limit-schedule", "", "This argument is a comma separated list of time of day windows with their own -limit-rate, eg: 09:00-18:00=5MB/s,18:00-09:00=0")
+	flag.StringVar(&a.Cfg.Listen, "listen", "", "This argument is the address of the HTTP status and control API, eg: :8080 or 127.0.0.1:8080")
+	flag.StringVar(&a.Cfg.OnFileDone, "on-file-done", "", "This argument is a command to run after every downloaded file, {path}, {name}, {size} and {job} are replaced in its arguments, eg: \"notify-library {path}\"")
+	flag.StringVar(&a.Cfg.OnSyncDone, "on-sync-done", "", "This argument is a command to run after every sync (every pass with -watch), {status}, {downloaded} and {failed} are replaced in its arguments and the JSON summary is written to its stdin")
+	flag.StringVar(&a.Cfg.Webhook, "webhook", "", "This argument is a URL that gets a POST with the JSON summary and failures after every sync")
+	flag.BoolVar(&a.Cfg.Move, "move", false, "This argument deletes every file from Premiumize once its download was verified, and the folders that become empty, files that failed are never deleted")
+	flag.BoolVar(&a.Cfg.ConfirmMove, "confirm-move", false, "This argument confirms -move without asking, it is required when we can't ask on a terminal")
+	flag.DurationVar(&a.Cfg.HookTimeout, "hook-timeout", 5*time.Minute, "This argument is how long a -on-file-done or -on-sync-done command may run before it is killed, 0 disables the timeout")
 	flag.Parse()
+	err = ApplyConfig(flag.CommandLine, a.Cfg.ConfigPath, a.Cfg.Profile)
+	if err != nil {
+		return fmt.Errorf("ApplyConfig: %w", err)
+	}
 
-	if a.Cfg.DownloadThreads > 9 {
-		a.Cfg.DownloadThreads = 9
+	if a.Cfg.DownloadThreads > MaxThreads {
+		a.Cfg.DownloadThreads = MaxThreads
 	}
 	if a.Cfg.DownloadThreads < 1 {
 		a.Cfg.DownloadThreads = 1
 	}
+	if a.Cfg.Retries < 0 {
+		a.Cfg.Retries = 0
+	}
+	if a.Cfg.Depth < 0 {
+		a.Cfg.Depth = 0
+	}
+	if a.Cfg.Watch > 0 && a.Cfg.WatchJitter == 0 {
+		a.Cfg.WatchJitter = a.Cfg.Watch / 10
+	}
+	if a.Cfg.Move && a.Cfg.Mirror {
+		// Mirror removes local files that are gone from the cloud, so it would remove everything we moved
+		return errors.New("-move can't be combined with -mirror")
+	}
 
 	if !a.Cfg.IgnoreParallel {
 
 	}
+	return nil
 }
 
 func (a *App) SetupLogger() error {
-	logFile, err := os.Create(strings.ReplaceAll(a.Cfg.LogName, ":UNIX_TIME", strconv.FormatInt(time.Now().Unix(), 10)))
+	a.LogPath = strings.ReplaceAll(a.Cfg.LogName, ":UNIX_TIME", strconv.FormatInt(time.Now().Unix(), 10))
+	logFile, err := os.Create(a.LogPath)
 	if err != nil {
 		return err
 	}
@@ -113,13 +215,40 @@ func (a *App) SetupHTTPClient() error {
 	}
 
 	var err error
-	a.DownloadClient, err = gokhttp_client.NewHTTPClient(opts...)
+	a.HTTPClient, err = gokhttp_client.NewHTTPClient(opts...)
 	if err != nil {
 		return fmt.Errorf("client.NewHTTPClient: %w", err)
 	}
+	a.RateSchedule, err = utils.ParseRateSchedule(a.Cfg.LimitRate, a.Cfg.LimitSchedule)
+	if err != nil {
+		return fmt.Errorf("utils.ParseRateSchedule: %w", err)
+	}
+	a.Limiter = utils.NewRateLimiter(a.RateSchedule.LimitAt(time.Now()))
+	if len(a.RateSchedule.Windows) > 0 {
+		go a.FollowRateSchedule()
+	}
+	if a.Metrics == nil {
+		a.Metrics = NewMetrics()
+	}
+	a.DownloadClient = &http.Client{Transport: &utils.LinkCheckTransport{Base: &utils.RateLimitTransport{Base: a.HTTPClient.Transport, Limiter: a.Limiter, Bytes: a.Metrics.DownloadedBytes}}}
+	// Only the API calls, the Premiumize client is created with this client
+	a.HTTPClient.Transport = &utils.ObserveTransport{Base: a.HTTPClient.Transport, Observe: a.Metrics.ObserveAPI}
 	return nil
 }
 
+// FollowRateSchedule changes the limit of the running downloads whenever the schedule moves to another window
+func (a *App) FollowRateSchedule() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		limit := a.RateSchedule.LimitAt(time.Now())
+		if limit != a.Limiter.Limit() {
+			a.BLog.Infof("Rate limit changed to %s/s by the schedule (0 is unlimited)", humanize.Bytes(uint64(limit)))
+			a.Limiter.SetLimit(limit)
+		}
+	}
+}
+
 func (a *App) SetupPremiumizeClient() error {
 	var session *api.PremiumizeSession
 	if len(a.Cfg.APIKey) == 0 {
@@ -131,10 +260,42 @@ func (a *App) SetupPremiumizeClient() error {
 	if len(a.Cfg.APIKey) > 0 {
 		session = &api.PremiumizeSession{SessionType: "apikey", AuthToken: a.Cfg.APIKey}
 	}
-	a.Client = premiumize_client.NewPremiumizeClient(session, a.DownloadClient)
+	a.Client = premiumize_client.NewPremiumizeClient(session, a.HTTPClient)
 	return nil
 }
 
+func (a *App) SetupFilter() error {
+	var err error
+	for _, job := range a.Jobs {
+		job.Filter, err = utils.NewFilter(a.Cfg.Include, a.Cfg.Exclude)
+		if err != nil {
+			return fmt.Errorf("utils.NewFilter: %w", err)
+		}
+		err = job.Filter.LoadIgnoreFile(filepath.Join(job.DestRoot, utils.IgnoreFileName))
+		if err != nil {
+			return fmt.Errorf("job.Filter.LoadIgnoreFile: %w", err)
+		}
+	}
+	a.Selector, err = utils.NewSelector(a.Cfg.MinSize, a.Cfg.MaxSize, a.Cfg.NewerThan, a.Cfg.OlderThan)
+	if err != nil {
+		return fmt.Errorf("utils.NewSelector: %w", err)
+	}
+	return nil
+}
+
+// ResetStats gets the download tracker ready for another pass in watch mode, the tracker is stopped at the end of every pass
+func (a *App) ResetStats() {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	a.Stats.GraceFulStop.Store(false)
+	a.Stats.IdleSince.Store(time.Time{})
+	a.Stats.TotalFiles.Store(0)
+	a.Stats.TotalBytes.Store(0)
+	a.Stats.DownloadedFiles.Store(0)
+	a.Stats.DownloadedBytes.Store(0)
+	a.Stats.PollIP(a.DownloadClient)
+}
+
 func (a *App) VersionRoutine() string {
 	result := strings.Builder{}
 	currentPrompt := CurrentCodeBase.PromptCurrentVersion(CurrentVersion)
@@ -1,17 +1,189 @@
 package app
 
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
 type Config struct {
+	ConfigPath      string
+	Profile         string
 	APIKey          string
 	DownloadThreads int
-	Folder          string
+	Folders         StringList
 	Recursive       bool
+	Depth           int
 	ProgressTimeOut int
 	Proxy           string
 	Debug           bool
 	Daemon          bool
 	Version         bool
 	IgnoreParallel  bool
+	LockTimeout     time.Duration
 	LogName         string
 	OutputAnalysis  bool
 	Repair          bool
+	StatePath       string
+	RebuildState    bool
+	Force           bool
+	Mirror          bool
+	DryRun          bool
+	MaxDeletions    int
+	TrashDir        string
+	Format          string
+	Retries         int
+	RetryDelay      int
+	Verify          bool
+	Requeue         bool
+	Dest            string
+	StripRoot       bool
+	Include         StringList
+	Exclude         StringList
+	MinSize         string
+	MaxSize         string
+	NewerThan       string
+	OlderThan       string
+	Watch           time.Duration
+	WatchJitter     time.Duration
+	HealthPath      string
+	LimitRate       string
+	LimitSchedule   string
+	Listen          string
+	OnFileDone      string
+	OnSyncDone      string
+	Webhook         string
+	HookTimeout     time.Duration
+	Move            bool
+	ConfirmMove     bool
+}
+
+// StringList is a flag that can be repeated
+type StringList []string
+
+func (l *StringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *StringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// EnvPrefix is the prefix of the environment variables that override flags
+const EnvPrefix = "PFS_"
+
+// EnvName returns the environment variable that overrides a flag, eg: PFS_DRY_RUN for -dry-run
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// FileConfig is the layout of the -config file, settings are keyed by flag name and a profile overrides the top level settings
+type FileConfig struct {
+	Settings map[string]interface{}            `yaml:",inline"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// LoadConfigFile reads a YAML config file and returns the settings of the profile (empty for only the top level settings) as flag values
+func LoadConfigFile(location, profile string) (map[string][]string, error) {
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	fileCfg := FileConfig{}
+	err = yaml.Unmarshal(data, &fileCfg)
+	if err != nil {
+		return nil, fmt.Errorf("yaml.Unmarshal: %w", err)
+	}
+
+	result := map[string][]string{}
+	layers := []map[string]interface{}{fileCfg.Settings}
+	if len(profile) > 0 {
+		profileSettings, ok := fileCfg.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile: %s", profile)
+		}
+		layers = append(layers, profileSettings)
+	}
+	for _, layer := range layers {
+		for key, value := range layer {
+			values := []string{}
+			switch typed := value.(type) {
+			case []interface{}:
+				for _, item := range typed {
+					values = append(values, fmt.Sprint(item))
+				}
+			case map[string]interface{}:
+				return nil, fmt.Errorf("setting %s can't be a map", key)
+			case nil:
+				// "key:" without a value clears what an earlier layer set, ApplyConfig then leaves the flag at its default
+			default:
+				values = append(values, fmt.Sprint(typed))
+			}
+			result[key] = values
+		}
+	}
+	return result, nil
+}
+
+// ApplyConfig fills in the flags that were not given on the command line, from the environment first (empty variables count as unset) and the config file (if any) second.
+// This makes the precedence flags > env > file > defaults, repeatable flags take a comma separated list from the environment.
+func ApplyConfig(flags *flag.FlagSet, location, profile string) error {
+	fileSettings := map[string][]string{}
+	if len(location) > 0 {
+		var err error
+		fileSettings, err = LoadConfigFile(location, profile)
+		if err != nil {
+			return fmt.Errorf("LoadConfigFile: %w", err)
+		}
+	} else if len(profile) > 0 {
+		return errors.New("a profile needs a config file")
+	}
+
+	unknown := []string{}
+	for name := range fileSettings {
+		if flags.Lookup(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings in config file: %s", strings.Join(unknown, ", "))
+	}
+
+	given := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] {
+			return
+		}
+		values, ok := fileSettings[f.Name]
+		if env := os.Getenv(EnvName(f.Name)); len(env) > 0 {
+			values, ok = []string{env}, true
+			if _, repeatable := f.Value.(*StringList); repeatable {
+				values = strings.Split(env, ",")
+			}
+		}
+		if !ok {
+			return
+		}
+		for _, value := range values {
+			err = flags.Set(f.Name, value)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", f.Name, err)
+				return
+			}
+		}
+	})
+	return err
 }
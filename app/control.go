@@ -0,0 +1,101 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+// MaxThreads is the most files we download in parallel
+const MaxThreads = 9
+
+// Control holds the settings that can be changed while a sync is running, eg: through the -listen API
+type Control struct {
+	paused  *atomic.Bool
+	threads *atomic.Int64
+
+	mu        sync.Mutex
+	running   map[string]context.CancelFunc // keyed by local path
+	cancelled map[string]bool
+}
+
+func NewControl(threads int) *Control {
+	c := &Control{
+		paused:    atomic.NewBool(false),
+		threads:   atomic.NewInt64(1),
+		running:   map[string]context.CancelFunc{},
+		cancelled: map[string]bool{},
+	}
+	c.SetThreads(threads)
+	return c
+}
+
+func (c *Control) Paused() bool {
+	return c.paused.Load()
+}
+
+func (c *Control) SetPaused(paused bool) {
+	c.paused.Store(paused)
+}
+
+// Threads returns how many files may be downloaded in parallel right now
+func (c *Control) Threads() int {
+	return int(c.threads.Load())
+}
+
+// SetThreads changes how many files may be downloaded in parallel, clamped between 1 and MaxThreads
+func (c *Control) SetThreads(threads int) int {
+	if threads > MaxThreads {
+		threads = MaxThreads
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	c.threads.Store(int64(threads))
+	return threads
+}
+
+// Start returns the context to download localPath with, it is cancelled by Cancel. Call the returned function once the download is over.
+func (c *Control) Start(ctx context.Context, localPath string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelled[localPath] {
+		cancel()
+	}
+	c.running[localPath] = cancel
+	return ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.running, localPath)
+		cancel()
+	}
+}
+
+// Cancel cancels the download of localPath, if it didn't start yet it is cancelled as soon as it does.
+// Returns true if it was running.
+func (c *Control) Cancel(localPath string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled[localPath] = true
+	cancel, ok := c.running[localPath]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// Cancelled returns true if the download of localPath was cancelled
+func (c *Control) Cancelled(localPath string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled[localPath]
+}
+
+// NextPass forgets the cancelled files in watch mode, SyncJob.EndPass kept them in Retry so the next pass starts them again
+func (c *Control) NextPass() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = map[string]bool{}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventVersion is the version of the -daemon event schema, it only changes when fields are renamed or removed, adding fields or event types keeps it
+const EventVersion = 1
+
+const (
+	EventCrawlStarted  = "crawl_started"
+	EventCrawlFinished = "crawl_finished"
+	EventFileQueued    = "file_queued"
+	EventFileProgress  = "file_progress"
+	EventFileDone      = "file_done"
+	EventFileFailed    = "file_failed"
+	EventSyncFinished  = "sync_finished"
+)
+
+// Event is a single line of the -daemon output, Data is one of the *Event structs below depending on Type
+type Event struct {
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data"`
+}
+
+type CrawlStartedEvent struct {
+	Folder string `json:"folder"`
+}
+
+type CrawlFinishedEvent struct {
+	Folder   string  `json:"folder"`
+	Files    int64   `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration"` // seconds
+}
+
+// FileEvent is used by file_queued and file_done, Path is the local path of the file
+type FileEvent struct {
+	Job      string `json:"job"`
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Attempts int    `json:"attempts"`
+}
+
+type FileProgressEvent struct {
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	Speed      int64  `json:"speed"` // bytes per second
+}
+
+type FileFailedEvent struct {
+	Job      string `json:"job"`
+	Path     string `json:"path"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+type SyncFinishedEvent struct {
+	Stopped bool        `json:"stopped"` // interrupted by a signal or the API
+	Jobs    []JobStatus `json:"jobs"`
+}
+
+// NewEvent wraps the data of an event in the versioned envelope
+func NewEvent(kind string, data interface{}) Event {
+	return Event{Version: EventVersion, Type: kind, Time: time.Now().UTC(), Data: data}
+}
+
+// Events writes the events as NDJSON, a nil *Events ignores them so callers don't have to check for -daemon
+type Events struct {
+	mu  sync.Mutex
+	w   io.Writer
+	Now func() time.Time
+}
+
+func NewEvents(w io.Writer) *Events {
+	return &Events{w: w, Now: time.Now}
+}
+
+func (e *Events) Emit(kind string, data interface{}) {
+	if e == nil {
+		return
+	}
+	// Paths and names are written as they are, "->" shouldn't become "-\u003e"
+	line := &bytes.Buffer{}
+	encoder := json.NewEncoder(line)
+	encoder.SetEscapeHTML(false)
+	event := NewEvent(kind, data)
+	event.Time = e.Now().UTC()
+	err := encoder.Encode(event)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.w.Write(line.Bytes())
+}
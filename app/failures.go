@@ -0,0 +1,72 @@
+package app
+
+import (
+	"sync"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+)
+
+type Failure struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// FailureList collects the files that permanently failed to download, workers add to it concurrently
+type FailureList struct {
+	mu    sync.Mutex
+	items []*Failure
+}
+
+func (f *FailureList) Add(failure *Failure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.items = append(f.items, failure)
+}
+
+func (f *FailureList) List() []*Failure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*Failure{}, f.items...)
+}
+
+// Reset empties the list and returns what was in it
+func (f *FailureList) Reset() []*Failure {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	items := f.items
+	f.items = nil
+	return items
+}
+
+// VerifiedList collects the files that were downloaded and verified, -move only ever deletes those from the cloud
+type VerifiedList struct {
+	mu    sync.Mutex
+	items map[*utils.PFile]string // local path
+}
+
+func (v *VerifiedList) Add(file *utils.PFile, path string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.items == nil {
+		v.items = map[*utils.PFile]string{}
+	}
+	v.items[file] = path
+}
+
+func (v *VerifiedList) List() map[*utils.PFile]string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	result := make(map[*utils.PFile]string, len(v.items))
+	for file, path := range v.items {
+		result[file] = path
+	}
+	return result
+}
+
+func (v *VerifiedList) Reset() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.items = nil
+}
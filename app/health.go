@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HealthStarting = "starting"
+	HealthSyncing  = "syncing"
+	HealthWaiting  = "waiting"
+	HealthStopping = "stopping"
+)
+
+// Health is written to the -health file in watch mode, a supervisor can tell a stuck process by the heartbeat getting old
+type Health struct {
+	mu       sync.Mutex
+	location string
+
+	PID          int       `json:"pid"`
+	Status       string    `json:"status"`
+	Heartbeat    time.Time `json:"heartbeat"`
+	Pass         int       `json:"pass"`
+	PassStarted  time.Time `json:"passStarted"`
+	PassFinished time.Time `json:"passFinished"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	NextPass     time.Time `json:"nextPass"`
+	Failures     int       `json:"failures"`
+	LastError    string    `json:"lastError,omitempty"`
+}
+
+// NewHealth returns nil without a location, all methods are no-ops on nil
+func NewHealth(location string) *Health {
+	if len(location) == 0 {
+		return nil
+	}
+	return &Health{location: location, PID: os.Getpid(), Status: HealthStarting}
+}
+
+// Update changes the health and writes it right away
+func (h *Health) Update(change func(h *Health)) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	change(h)
+	return h.write()
+}
+
+// Beat rewrites the health every interval until done is closed
+func (h *Health) Beat(interval time.Duration, done <-chan struct{}) {
+	if h == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_ = h.Update(func(h *Health) {})
+		}
+	}
+}
+
+func (h *Health) write() error {
+	h.Heartbeat = time.Now()
+	data, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	tmp := h.location + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	err = os.Rename(tmp, h.location)
+	if err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
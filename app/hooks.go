@@ -0,0 +1,185 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+	"github.com/BRUHItsABunny/bunnlog"
+)
+
+const (
+	// maxFileHooks is how many -on-file-done commands run at the same time, the next ones wait so downloads don't pile up processes
+	maxFileHooks     = 4
+	webhookAttempts  = 3
+	webhookRetryWait = 5 * time.Second
+)
+
+const (
+	SyncStatusOK      = "ok"
+	SyncStatusFailed  = "failed"
+	SyncStatusStopped = "stopped"
+)
+
+// Hooks runs the -on-file-done and -on-sync-done commands and posts to the -webhook, a nil *Hooks or empty settings do nothing
+type Hooks struct {
+	FileDone []string
+	SyncDone []string
+	Webhook  string
+	Timeout  time.Duration
+	Client   *http.Client
+	bLog     *bunnlog.BunnyLog
+	slots    chan struct{}
+	running  sync.WaitGroup
+}
+
+func NewHooks(cfg *Config, bLog *bunnlog.BunnyLog) (*Hooks, error) {
+	h := &Hooks{Webhook: cfg.Webhook, Timeout: cfg.HookTimeout, bLog: bLog, slots: make(chan struct{}, maxFileHooks)}
+	var err error
+	if len(cfg.OnFileDone) > 0 {
+		h.FileDone, err = utils.SplitCommand(cfg.OnFileDone)
+		if err != nil {
+			return nil, fmt.Errorf("-on-file-done: %w", err)
+		}
+	}
+	if len(cfg.OnSyncDone) > 0 {
+		h.SyncDone, err = utils.SplitCommand(cfg.OnSyncDone)
+		if err != nil {
+			return nil, fmt.Errorf("-on-sync-done: %w", err)
+		}
+	}
+	if len(h.Webhook) > 0 {
+		parsed, err := url.Parse(h.Webhook)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse: %w", err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, errors.New("-webhook must be a http or https URL")
+		}
+		h.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return h, nil
+}
+
+// OnFileDone starts the -on-file-done command in the background, Wait waits for it
+func (h *Hooks) OnFileDone(ctx context.Context, job *SyncJob, file *utils.PFile, path string) {
+	if h == nil || len(h.FileDone) == 0 {
+		return
+	}
+	args := utils.ExpandCommand(h.FileDone, map[string]string{
+		"path": path,
+		"name": file.Name.Load(),
+		"size": strconv.FormatInt(file.Size.Load(), 10),
+		"job":  job.Name(),
+	})
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		h.slots <- struct{}{}
+		defer func() { <-h.slots }()
+		h.run(ctx, "-on-file-done", args, nil)
+	}()
+}
+
+// Wait blocks until all -on-file-done commands finished
+func (h *Hooks) Wait() {
+	if h == nil {
+		return
+	}
+	h.running.Wait()
+}
+
+// OnSyncDone runs the -on-sync-done command with the summary on its stdin and posts the summary to the -webhook
+func (h *Hooks) OnSyncDone(ctx context.Context, status string, summary *SyncFinishedEvent) {
+	if h == nil || (len(h.SyncDone) == 0 && len(h.Webhook) == 0) {
+		return
+	}
+	payload, err := json.Marshal(NewEvent(EventSyncFinished, summary))
+	if err != nil {
+		h.bLog.Errorf("Hooks: json.Marshal: %s", err.Error())
+		return
+	}
+	if len(h.SyncDone) > 0 {
+		downloaded, failed := int64(0), 0
+		for _, job := range summary.Jobs {
+			downloaded += job.Downloaded
+			failed += len(job.Failures)
+		}
+		args := utils.ExpandCommand(h.SyncDone, map[string]string{
+			"status":     status,
+			"downloaded": strconv.FormatInt(downloaded, 10),
+			"failed":     strconv.Itoa(failed),
+		})
+		h.run(ctx, "-on-sync-done", args, payload)
+	}
+	if len(h.Webhook) > 0 {
+		h.post(ctx, payload)
+	}
+}
+
+// run executes a hook, its output goes to the log since stdout is reserved for the UI or the -daemon events
+func (h *Hooks) run(ctx context.Context, name string, args []string, stdin []byte) {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		h.bLog.Errorf("Hooks: %s %q failed: %s: %s", name, args, err.Error(), string(output))
+		return
+	}
+	h.bLog.Infof("Hooks: %s %q: %s", name, args, string(output))
+}
+
+func (h *Hooks) post(ctx context.Context, payload []byte) {
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		err = h.postOnce(ctx, payload)
+		if err == nil {
+			return
+		}
+		h.bLog.Warnf("Hooks: webhook attempt %d failed: %s", attempt, err.Error())
+		if attempt < webhookAttempts {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(webhookRetryWait):
+			}
+		}
+	}
+	h.bLog.Errorf("Hooks: giving up on the webhook: %s", err.Error())
+}
+
+func (h *Hooks) postOnce(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.Webhook, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Premiumize-File-Sync/"+AppVersion)
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("h.Client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
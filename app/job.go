@@ -0,0 +1,168 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+	"go.uber.org/atomic"
+)
+
+// SyncJob is one remote folder synced to one local destination, the jobs of a run share the workers and the download tracker
+type SyncJob struct {
+	Folder    string            // remote folder as given on the command line
+	DestRoot  string            // local folder as given on the command line
+	Directory *utils.PDirectory // only replaced through SetDirectory, the API reads it with Tree
+	Dest      utils.Destination
+	Filter    *utils.Filter
+	State     *utils.SyncState
+	Skip      map[string]bool // local paths that don't need downloading, filled once before the download loop starts
+	Stale     map[string]bool // local paths that have to be downloaded again from scratch, filled alongside Skip
+	Failures  *FailureList
+	Verified  *VerifiedList
+	Previous  *utils.PDirectory // snapshot of the previous crawl in watch mode, nil on the first pass
+	Retry     map[string]bool   // local paths that are still pending from an earlier pass in watch mode, filled by EndPass
+
+	// Summary of the run
+	Downloaded      *atomic.Int64
+	DownloadedBytes *atomic.Int64
+	Skipped         *atomic.Int64
+	Cancelled       *atomic.Int64
+	Moved           *atomic.Int64 // deleted from the cloud by -move
+
+	mu sync.RWMutex // guards Directory and Previous
+}
+
+// NewSyncJob parses a "src=dest" folder argument, without "=" the folder is synced into defaultDest.
+// It splits on the first "=", so local paths may contain one but remote folders can't.
+func NewSyncJob(spec, defaultDest string) (*SyncJob, error) {
+	folder, dest := spec, defaultDest
+	if idx := strings.Index(spec, "="); idx >= 0 {
+		folder, dest = spec[:idx], spec[idx+1:]
+	}
+	if len(folder) == 0 {
+		return nil, errors.New("missing remote folder")
+	}
+	if len(dest) == 0 {
+		dest = "."
+	}
+	return &SyncJob{
+		Folder:          folder,
+		DestRoot:        dest,
+		Failures:        &FailureList{},
+		Verified:        &VerifiedList{},
+		Downloaded:      atomic.NewInt64(0),
+		DownloadedBytes: atomic.NewInt64(0),
+		Skipped:         atomic.NewInt64(0),
+		Cancelled:       atomic.NewInt64(0),
+		Moved:           atomic.NewInt64(0),
+	}, nil
+}
+
+// EndPass remembers the files that are still pending after a pass in watch mode, so the next pass doesn't skip them as unchanged.
+// Every file that was neither skipped nor downloaded is pending: it failed, got cancelled or wasn't started because the pass ended early.
+// Only a pass that ran ends, Retry survives a crawl that failed.
+func (j *SyncJob) EndPass() {
+	downloaded := map[string]bool{}
+	for _, path := range j.Verified.List() {
+		downloaded[path] = true
+	}
+	j.Retry = map[string]bool{}
+	utils.WalkFiles(j.Tree(), func(file *utils.PFile) {
+		path := j.Dest.Path(file)
+		if !j.Skip[path] && !downloaded[path] {
+			j.Retry[path] = true
+		}
+	})
+}
+
+// NextPass gets the job ready for another pass in watch mode, what is still pending was remembered by EndPass
+func (j *SyncJob) NextPass() {
+	j.Failures.Reset()
+	j.Verified.Reset()
+	j.Downloaded.Store(0)
+	j.DownloadedBytes.Store(0)
+	j.Skipped.Store(0)
+	j.Cancelled.Store(0)
+	j.Moved.Store(0)
+}
+
+// SetDirectory stores the tree of a new crawl, the previous tree is kept to find the changes in watch mode
+func (j *SyncJob) SetDirectory(dir *utils.PDirectory) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Previous, j.Directory = j.Directory, dir
+}
+
+// Tree returns the tree of the last crawl, it's safe to call while a pass is running
+func (j *SyncJob) Tree() *utils.PDirectory {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.Directory
+}
+
+// Name identifies the job in logs and summaries
+func (j *SyncJob) Name() string {
+	return j.Folder + " -> " + j.DestRoot
+}
+
+// BuildLocalTree builds the tree of the local copy of the synced folder, without the files our filters leave out
+func (j *SyncJob) BuildLocalTree() (*utils.PDirectory, error) {
+	localDir, err := utils.BuildDirectoryTree(j.Dest.LocalRoot())
+	if err != nil {
+		return nil, err
+	}
+	j.Filter.Prune(localDir)
+	return localDir, nil
+}
+
+// SetupJobs creates a job for every -folder argument
+func (a *App) SetupJobs() error {
+	if len(a.Cfg.Folders) > 1 && len(a.Cfg.StatePath) > 0 {
+		return errors.New("-state can only be used with a single -folder")
+	}
+	a.Jobs = make([]*SyncJob, 0, len(a.Cfg.Folders))
+	for _, spec := range a.Cfg.Folders {
+		job, err := NewSyncJob(spec, a.Cfg.Dest)
+		if err != nil {
+			return fmt.Errorf("folder %q: %w", spec, err)
+		}
+		a.Jobs = append(a.Jobs, job)
+	}
+	return nil
+}
+
+// SetupState loads the sync state of a job, its tree must be crawled first
+func (a *App) SetupState(job *SyncJob) error {
+	location := a.Cfg.StatePath
+	if len(location) == 0 {
+		location = filepath.Join(job.Dest.LocalRoot(), utils.DefaultStateName)
+	}
+
+	var err error
+	job.State, err = utils.LoadState(location)
+	if err != nil {
+		return fmt.Errorf("utils.LoadState: %w", err)
+	}
+
+	if a.Cfg.RebuildState {
+		localDir, err := utils.BuildDirectoryTree(job.Dest.LocalRoot())
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("utils.BuildDirectoryTree: %w", err)
+			}
+			localDir = &utils.PDirectory{}
+		}
+		recorded := job.State.Rebuild(localDir, job.Directory, job.Dest)
+		a.BLog.Infof("Rebuilt sync state of %s from disk with %d files", job.Name(), recorded)
+		err = job.State.Save()
+		if err != nil {
+			return fmt.Errorf("job.State.Save: %w", err)
+		}
+	}
+	return nil
+}
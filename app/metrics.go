@@ -0,0 +1,173 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// apiLatencyBuckets are the upper bounds in seconds of the API latency histogram
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics are the counters and gauges that aren't already kept by the tracker or the jobs, the counters never reset between passes
+type Metrics struct {
+	DownloadedBytes *atomic.Uint64
+	FilesCompleted  *atomic.Uint64
+	FilesFailed     *atomic.Uint64
+	FilesSkipped    *atomic.Uint64
+	FilesCancelled  *atomic.Uint64
+	FilesMoved      *atomic.Uint64
+	Retries         *atomic.Uint64
+	LinkRefreshes   *atomic.Uint64
+	ActiveWorkers   *atomic.Int64
+	QueueDepth      *atomic.Int64 // files planned for download that no worker picked up yet
+
+	mu            sync.Mutex
+	crawlDuration map[string]float64 // last crawl of each folder in seconds
+	api           map[string]*apiMetrics
+}
+
+type apiMetrics struct {
+	requests uint64
+	errors   uint64
+	sum      float64
+	buckets  []uint64 // cumulative, one per apiLatencyBuckets
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		DownloadedBytes: atomic.NewUint64(0),
+		FilesCompleted:  atomic.NewUint64(0),
+		FilesFailed:     atomic.NewUint64(0),
+		FilesSkipped:    atomic.NewUint64(0),
+		FilesCancelled:  atomic.NewUint64(0),
+		FilesMoved:      atomic.NewUint64(0),
+		Retries:         atomic.NewUint64(0),
+		LinkRefreshes:   atomic.NewUint64(0),
+		ActiveWorkers:   atomic.NewInt64(0),
+		QueueDepth:      atomic.NewInt64(0),
+		crawlDuration:   map[string]float64{},
+		api:             map[string]*apiMetrics{},
+	}
+}
+
+// ObserveCrawl records how long crawling a folder took
+func (m *Metrics) ObserveCrawl(folder string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.crawlDuration[folder] = duration.Seconds()
+}
+
+// ObserveAPI records an API request, it fits utils.ObserveTransport
+func (m *Metrics) ObserveAPI(req *http.Request, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	endpoint := req.URL.Path
+	api, ok := m.api[endpoint]
+	if !ok {
+		api = &apiMetrics{buckets: make([]uint64, len(apiLatencyBuckets))}
+		m.api[endpoint] = api
+	}
+	api.requests++
+	if err != nil {
+		api.errors++
+	}
+	seconds := duration.Seconds()
+	api.sum += seconds
+	for i, bound := range apiLatencyBuckets {
+		if seconds <= bound {
+			api.buckets[i]++
+		}
+	}
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format
+func (a *App) WriteMetrics(w io.Writer) {
+	m := a.Metrics
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("pfs_downloaded_bytes_total", "counter", "Bytes read from download links.", m.DownloadedBytes.Load())
+	metric("pfs_files_completed_total", "counter", "Files downloaded and verified.", m.FilesCompleted.Load())
+	metric("pfs_files_failed_total", "counter", "Files that failed after all attempts.", m.FilesFailed.Load())
+	metric("pfs_files_skipped_total", "counter", "Files that didn't need downloading.", m.FilesSkipped.Load())
+	metric("pfs_files_cancelled_total", "counter", "Files cancelled through the API.", m.FilesCancelled.Load())
+	metric("pfs_files_moved_total", "counter", "Files deleted from Premiumize by -move.", m.FilesMoved.Load())
+	metric("pfs_retries_total", "counter", "Download attempts that were retried.", m.Retries.Load())
+	metric("pfs_link_refreshes_total", "counter", "Expired download links that were refreshed.", m.LinkRefreshes.Load())
+	metric("pfs_active_workers", "gauge", "Workers that are downloading a file.", m.ActiveWorkers.Load())
+	metric("pfs_queue_depth", "gauge", "Files waiting for a worker.", m.QueueDepth.Load())
+	if a.Control != nil {
+		metric("pfs_threads", "gauge", "Maximum number of concurrent downloads.", a.Control.Threads())
+		metric("pfs_paused", "gauge", "1 if downloads are paused.", boolMetric(a.Control.Paused()))
+	}
+	if a.Limiter != nil {
+		metric("pfs_rate_limit_bytes", "gauge", "Download rate limit in bytes per second, 0 is unlimited.", a.Limiter.Limit())
+	}
+	if a.Stats != nil {
+		metric("pfs_tracker_tasks", "gauge", "Download tasks in the tracker.", a.Stats.Tasks.Len())
+		metric("pfs_tracker_total_files", "gauge", "Files left to download in this pass.", a.Stats.TotalFiles.Load())
+		metric("pfs_tracker_total_bytes", "gauge", "Bytes left to download in this pass.", a.Stats.TotalBytes.Load())
+		metric("pfs_tracker_downloaded_files", "gauge", "Files downloaded in this pass.", a.Stats.DownloadedFiles.Load())
+		metric("pfs_tracker_downloaded_bytes", "gauge", "Bytes downloaded in this pass.", a.Stats.DownloadedBytes.Load())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprint(w, "# HELP pfs_crawl_duration_seconds Duration of the last crawl of a folder.\n# TYPE pfs_crawl_duration_seconds gauge\n")
+	for _, folder := range sortedKeys(m.crawlDuration) {
+		fmt.Fprintf(w, "pfs_crawl_duration_seconds{folder=\"%s\"} %v\n", escapeLabel(folder), m.crawlDuration[folder])
+	}
+	fmt.Fprint(w, "# HELP pfs_api_requests_total Premiumize API requests.\n# TYPE pfs_api_requests_total counter\n")
+	for _, endpoint := range sortedKeys(m.api) {
+		fmt.Fprintf(w, "pfs_api_requests_total{endpoint=\"%s\"} %d\n", escapeLabel(endpoint), m.api[endpoint].requests)
+	}
+	fmt.Fprint(w, "# HELP pfs_api_errors_total Premiumize API requests that failed.\n# TYPE pfs_api_errors_total counter\n")
+	for _, endpoint := range sortedKeys(m.api) {
+		fmt.Fprintf(w, "pfs_api_errors_total{endpoint=\"%s\"} %d\n", escapeLabel(endpoint), m.api[endpoint].errors)
+	}
+	fmt.Fprint(w, "# HELP pfs_api_request_duration_seconds Latency of Premiumize API requests.\n# TYPE pfs_api_request_duration_seconds histogram\n")
+	for _, endpoint := range sortedKeys(m.api) {
+		api, label := m.api[endpoint], escapeLabel(endpoint)
+		for i, bound := range apiLatencyBuckets {
+			fmt.Fprintf(w, "pfs_api_request_duration_seconds_bucket{endpoint=\"%s\",le=\"%v\"} %d\n", label, bound, api.buckets[i])
+		}
+		fmt.Fprintf(w, "pfs_api_request_duration_seconds_bucket{endpoint=\"%s\",le=\"+Inf\"} %d\n", label, api.requests)
+		fmt.Fprintf(w, "pfs_api_request_duration_seconds_sum{endpoint=\"%s\"} %v\n", label, api.sum)
+		fmt.Fprintf(w, "pfs_api_request_duration_seconds_count{endpoint=\"%s\"} %d\n", label, api.requests)
+	}
+}
+
+func (a *App) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	a.WriteMetrics(w)
+}
+
+func boolMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a label value, the format only knows backslashes, quotes and newlines
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+)
+
+// JobStatus is the summary of a job in the API
+type JobStatus struct {
+	Name            string     `json:"name"`
+	Folder          string     `json:"folder"`
+	Dest            string     `json:"dest"`
+	Downloaded      int64      `json:"downloaded"`
+	DownloadedBytes int64      `json:"downloadedBytes"`
+	Skipped         int64      `json:"skipped"`
+	Cancelled       int64      `json:"cancelled"`
+	Moved           int64      `json:"moved"`
+	Failures        []*Failure `json:"failures"`
+}
+
+// Status is the response of GET /status
+type Status struct {
+	Paused    bool          `json:"paused"`
+	Stopping  bool          `json:"stopping"`
+	Threads   int           `json:"threads"`
+	RateLimit int64         `json:"rateLimit"` // bytes per second, 0 is unlimited
+	Tracker   TrackerStatus `json:"tracker"`
+	Jobs      []JobStatus   `json:"jobs"`
+}
+
+// TrackerStatus is a copy of the download tracker, the tasks themselves are served by GET /tasks
+type TrackerStatus struct {
+	IdleSince       time.Time `json:"idleSince"`
+	LastTick        time.Time `json:"lastTick"`
+	CurrentIP       string    `json:"currentIP"`
+	TotalThreads    uint64    `json:"totalThreads"`
+	Tasks           int       `json:"tasks"`
+	TotalFiles      uint64    `json:"totalFiles"`
+	TotalBytes      uint64    `json:"totalBytes"`
+	DownloadedFiles uint64    `json:"downloadedFiles"`
+	DownloadedBytes uint64    `json:"downloadedBytes"`
+	DeltaBytes      uint64    `json:"deltaBytes"`
+}
+
+// TreeNode is a crawled directory in GET /tree
+type TreeNode struct {
+	Name        string      `json:"name"`
+	Path        string      `json:"path"`
+	TotalSize   int64       `json:"totalSize"`
+	FileCount   int64       `json:"fileCount"`
+	Files       []TreeFile  `json:"files"`
+	Directories []*TreeNode `json:"directories"`
+	Truncated   []string    `json:"truncated,omitempty"`
+}
+
+type TreeFile struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// Serve starts the HTTP status and control API on the -listen address, it is closed with the Shutdown
+func (a *App) Serve() error {
+	listener, err := net.Listen("tcp", a.Cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("net.Listen: %w", err)
+	}
+	server := &http.Server{Handler: a.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.BLog.Errorf("API: %s", err.Error())
+		}
+	}()
+	a.Shutdown.OnExit(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	})
+	a.BLog.Infof("API: listening on %s", listener.Addr().String())
+	return nil
+}
+
+// Handler returns the routes of the API
+func (a *App) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", a.handleStatus)
+	mux.HandleFunc("GET /tasks", a.handleTasks)
+	mux.HandleFunc("GET /tree", a.handleTree)
+	mux.HandleFunc("GET /metrics", a.handleMetrics)
+	mux.HandleFunc("POST /pause", a.handlePause(true))
+	mux.HandleFunc("POST /resume", a.handlePause(false))
+	mux.HandleFunc("POST /cancel", a.handleCancel)
+	mux.HandleFunc("POST /threads", a.handleThreads)
+	mux.HandleFunc("POST /stop", a.handleStop)
+	return mux
+}
+
+func (a *App) handleStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Paused:    a.Control.Paused(),
+		Stopping:  a.Shutdown.Stopping.Err() != nil,
+		Threads:   a.Control.Threads(),
+		RateLimit: a.Limiter.Limit(),
+		Tracker:   a.TrackerStatus(),
+		Jobs:      a.JobStatuses(),
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// TrackerStatus copies the download tracker, ResetStats can't run halfway through it
+func (a *App) TrackerStatus() TrackerStatus {
+	a.statsMu.RLock()
+	defer a.statsMu.RUnlock()
+	return TrackerStatus{
+		IdleSince:       a.Stats.IdleSince.Load(),
+		LastTick:        a.Stats.LastTick.Load(),
+		CurrentIP:       a.Stats.CurrentIP.Load(),
+		TotalThreads:    a.Stats.TotalThreads.Load(),
+		Tasks:           a.Stats.Tasks.Len(),
+		TotalFiles:      a.Stats.TotalFiles.Load(),
+		TotalBytes:      a.Stats.TotalBytes.Load(),
+		DownloadedFiles: a.Stats.DownloadedFiles.Load(),
+		DownloadedBytes: a.Stats.DownloadedBytes.Load(),
+		DeltaBytes:      a.Stats.DeltaBytes.Load(),
+	}
+}
+
+// JobStatuses summarizes the current pass of every job
+func (a *App) JobStatuses() []JobStatus {
+	result := make([]JobStatus, 0, len(a.Jobs))
+	for _, job := range a.Jobs {
+		result = append(result, JobStatus{
+			Name:            job.Name(),
+			Folder:          job.Folder,
+			Dest:            job.DestRoot,
+			Downloaded:      job.Downloaded.Load(),
+			DownloadedBytes: job.DownloadedBytes.Load(),
+			Skipped:         job.Skipped.Load(),
+			Cancelled:       job.Cancelled.Load(),
+			Moved:           job.Moved.Load(),
+			Failures:        job.Failures.List(),
+		})
+	}
+	return result
+}
+
+func (a *App) handleTasks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.Stats.Tasks)
+}
+
+// handleTree returns the crawled tree of every job, or of the job with index ?job=N
+func (a *App) handleTree(w http.ResponseWriter, r *http.Request) {
+	jobs := a.Jobs
+	if query := r.URL.Query().Get("job"); len(query) > 0 {
+		index, err := strconv.Atoi(query)
+		if err != nil || index < 0 || index >= len(a.Jobs) {
+			writeError(w, http.StatusBadRequest, "job must be the index of a job")
+			return
+		}
+		jobs = a.Jobs[index : index+1]
+	}
+	result := make([]*TreeNode, 0, len(jobs))
+	for _, job := range jobs {
+		dir := job.Tree()
+		if dir == nil {
+			// Not crawled yet
+			result = append(result, nil)
+			continue
+		}
+		result = append(result, newTreeNode(dir))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (a *App) handlePause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.Control.SetPaused(paused)
+		a.Limiter.SetPaused(paused)
+		a.BLog.Infof("API: paused set to %v", paused)
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": paused})
+	}
+}
+
+// handleCancel cancels the file with the local path ?path=, a running download stops and a queued one never starts
+func (a *App) handleCancel(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if len(path) == 0 {
+		writeError(w, http.StatusBadRequest, "missing path")
+		return
+	}
+	running := a.Control.Cancel(path)
+	a.BLog.Infof("API: cancelled %s (running: %v)", path, running)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"path": path, "running": running})
+}
+
+// handleThreads changes the thread count to ?n=, it only goes above -threads when the workers were started with -listen
+func (a *App) handleThreads(w http.ResponseWriter, r *http.Request) {
+	threads, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "n must be a number")
+		return
+	}
+	threads = a.Control.SetThreads(threads)
+	a.BLog.Infof("API: threads set to %d", threads)
+	writeJSON(w, http.StatusOK, map[string]int{"threads": threads})
+}
+
+func (a *App) handleStop(w http.ResponseWriter, r *http.Request) {
+	a.BLog.Info("API: graceful stop requested")
+	a.Shutdown.Stop()
+	writeJSON(w, http.StatusAccepted, map[string]bool{"stopping": true})
+}
+
+func newTreeNode(dir *utils.PDirectory) *TreeNode {
+	node := &TreeNode{
+		Name:        dir.Name.Load(),
+		Path:        dir.Path.Load(),
+		TotalSize:   dir.TotalSize.Load(),
+		FileCount:   dir.FileCount.Load(),
+		Files:       make([]TreeFile, 0, len(dir.Files)),
+		Directories: make([]*TreeNode, 0, len(dir.Directories)),
+	}
+	for _, file := range dir.Files {
+		treeFile := TreeFile{ID: file.ID.Load(), Name: file.Name.Load(), Size: file.Size.Load()}
+		if file.Created != nil {
+			treeFile.Created = file.Created.Load()
+		}
+		node.Files = append(node.Files, treeFile)
+	}
+	sort.Slice(node.Files, func(i, j int) bool {
+		return node.Files[i].Name < node.Files[j].Name
+	})
+	for _, child := range dir.Directories {
+		node.Directories = append(node.Directories, newTreeNode(child))
+	}
+	sort.Slice(node.Directories, func(i, j int) bool {
+		return node.Directories[i].Name < node.Directories[j].Name
+	})
+	for name := range dir.Truncated {
+		node.Truncated = append(node.Truncated, name)
+	}
+	sort.Strings(node.Truncated)
+	return node
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BRUHItsABunny/bunnlog"
+)
+
+// AbortGracePeriod is how long the program may take to wind down after the second signal before it is killed, cleanups still run
+const AbortGracePeriod = 10 * time.Second
+
+// Shutdown turns the first SIGINT or SIGTERM into a graceful stop and the second one into an abort
+type Shutdown struct {
+	// Done after the first signal, no new files are started and the running ones get to finish
+	Stopping context.Context
+	// Done after the second signal, the running downloads are cancelled
+	Aborted context.Context
+
+	stop     context.CancelFunc
+	abort    context.CancelFunc
+	bLog     *bunnlog.BunnyLog
+	signals  chan os.Signal
+	mu       sync.Mutex
+	cleanups []func()
+	closed   bool
+}
+
+// NewShutdown starts listening for SIGINT and SIGTERM
+func NewShutdown(bLog *bunnlog.BunnyLog) *Shutdown {
+	s := &Shutdown{bLog: bLog, signals: make(chan os.Signal, 2)}
+	s.Stopping, s.stop = context.WithCancel(context.Background())
+	s.Aborted, s.abort = context.WithCancel(context.Background())
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+	go s.listen()
+	return s
+}
+
+func (s *Shutdown) listen() {
+	for sig := range s.signals {
+		if s.Stopping.Err() == nil {
+			s.bLog.Warnf("Got %s, finishing the running downloads, send it again to abort them", sig)
+			s.Stop()
+			continue
+		}
+		s.bLog.Warnf("Got %s again, aborting the running downloads", sig)
+		s.Abort()
+		go func() {
+			time.Sleep(AbortGracePeriod)
+			s.bLog.Error("Didn't stop in time after aborting, exiting")
+			s.Close()
+			os.Exit(130)
+		}()
+		return
+	}
+}
+
+// Stop stops enqueueing files, the running downloads get to finish.
+// The tracker's GraceFulStop is left alone because it closes the running downloads, syncJobs sets it once the workers are done.
+func (s *Shutdown) Stop() {
+	s.stop()
+}
+
+// Abort stops and cancels the running downloads
+func (s *Shutdown) Abort() {
+	s.Stop()
+	s.abort()
+}
+
+// OnExit registers a cleanup that runs on Close, even when the program is killed after an abort
+func (s *Shutdown) OnExit(cleanup func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cleanups = append(s.cleanups, cleanup)
+}
+
+// Close stops listening for signals and runs the cleanups once, the last one registered runs first
+func (s *Shutdown) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	signal.Stop(s.signals)
+	for i := len(s.cleanups) - 1; i >= 0; i-- {
+		s.cleanups[i]()
+	}
+}
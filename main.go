@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/BRUHItsABunny/Premiumize-File-Sync/app"
@@ -17,14 +19,14 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func downloadLoop(appData *app.App, dir *utils.PDirectory, workChan chan *gokhttp_download.ThreadedDownloadTask) {
+func downloadLoop(ctx context.Context, appData *app.App, job *app.SyncJob, dir *utils.PDirectory, workChan chan *Job) {
 	var (
 		err error
 	)
 	if dir == nil {
-		dir = appData.Directory
+		dir = job.Directory
 	}
-	appData.BLog.Infof("DLLoop: Starting to download directory: %s", appData.Directory.Path.Load())
+	appData.BLog.Infof("DLLoop: Starting to download directory: %s", dir.Path.Load())
 
 	files := []string{}
 	for _, fObj := range dir.Files {
@@ -33,31 +35,58 @@ func downloadLoop(appData *app.App, dir *utils.PDirectory, workChan chan *gokhtt
 	sort.Sort(sort.StringSlice(files))
 
 	for i := 0; i < len(files); i++ {
-		if appData.Stats.GraceFulStop.Load() {
+		if appData.Stats.GraceFulStop.Load() || ctx.Err() != nil {
 			appData.BLog.Debug("DLLoop stopping - graceful stop")
 			break
 		}
 
-		if appData.Stats.Tasks.Len() >= appData.Cfg.DownloadThreads {
-			appData.BLog.Debug("DLLoop: Sending nil task")
-			// Don't spam tracker with tasks we don't actively run
-			workChan <- nil
-			appData.BLog.Debug("DLLoop: Sent nil task")
+		if appData.Stats.Tasks.Len() >= appData.Control.Threads() || appData.Control.Paused() {
+			// Don't spam tracker with tasks we don't actively run, the thread count can change while we wait
+			time.Sleep(250 * time.Millisecond)
 			i--
 		} else {
 			file := dir.Files[files[i]]
+			localPath := job.Dest.Path(file)
+			if job.Skip[localPath] {
+				appData.BLog.Debugf("DLLoop: Skipping complete file: %s", file.Name.Load())
+				continue
+			}
+			if appData.Control.Cancelled(localPath) {
+				appData.BLog.Infof("DLLoop: Skipping cancelled file: %s", file.Name.Load())
+				appData.Metrics.QueueDepth.Dec()
+				cancelJob(appData, &Job{Sync: job, File: file})
+				continue
+			}
+			if appData.Cfg.Force || job.Stale[localPath] {
+				// The task appends to whatever is on disk, start from scratch
+				for _, path := range []string{localPath, utils.PartPath(localPath)} {
+					err = os.Remove(path)
+					if err != nil && !os.IsNotExist(err) {
+						appData.BLog.Warnf("DLLoop: Failed to remove file before redownloading: %s", err.Error())
+					}
+				}
+				err = nil
+			}
 			appData.BLog.Infof("DLLoop: Preparing task: %s", file.Name.Load())
-			task, err := gokhttp_download.NewThreadedDownloadTask(context.Background(), appData.DownloadClient, appData.Stats, file.GetFullPath(), file.Link.Load(), 1, uint64(file.Size.Load())) //requests.NewHeaderOption(http.Header{"Accept-Encoding": []string{"identity"}})
+			task, err := newTask(appData, job, file)
 			if err != nil {
-				err = fmt.Errorf("download.NewThreadedDownloadTask: %w", err)
-				appData.BLog.Error("DLLoop: Failed to prepare task: %s", err.Error())
-				break
+				appData.BLog.Errorf("DLLoop: Failed to prepare task: %s", err.Error())
+				appData.Metrics.QueueDepth.Dec()
+				failJob(appData, &Job{Sync: job, File: file, Attempts: 1}, err)
+				continue
 			}
-			appData.Stats.TotalFiles.Dec()
-			appData.Stats.TotalBytes.Sub(task.TaskStats.FileSize.Load())
 			appData.BLog.Infof("DLLoop: Sending task: %s", file.Name.Load())
-			workChan <- task
-			appData.BLog.Infof("DLLoop: Sent task: %s", file.Name.Load())
+			appData.Events.Emit(app.EventFileQueued, &app.FileEvent{Job: job.Name(), Path: localPath, Size: file.Size.Load()})
+			select {
+			case workChan <- &Job{Sync: job, File: file, Task: task}:
+				appData.BLog.Infof("DLLoop: Sent task: %s", file.Name.Load())
+			case <-ctx.Done():
+				// The workers are gone, the part file is kept for the next run
+				appData.BLog.Debugf("DLLoop: Dropping task: %s", file.Name.Load())
+				appData.Metrics.QueueDepth.Dec()
+				discardTask(appData, task)
+				return
+			}
 		}
 
 	}
@@ -70,20 +99,257 @@ func downloadLoop(appData *app.App, dir *utils.PDirectory, workChan chan *gokhtt
 		sort.Strings(subDirs)
 
 		for _, key := range subDirs {
-			if appData.Stats.GraceFulStop.Load() {
+			if appData.Stats.GraceFulStop.Load() || ctx.Err() != nil {
 				appData.BLog.Debug("DLLoop stopping (recursion) - graceful stop")
 				break
 			}
-			downloadLoop(appData, dir.Directories[key], workChan)
+			downloadLoop(ctx, appData, job, dir.Directories[key], workChan)
+		}
+	}
+}
+
+// planDownloads marks every file that doesn't need downloading before the download loop starts and takes it out of the totals, so the ETA only reflects the remaining work
+func planDownloads(appData *app.App, job *app.SyncJob) error {
+	job.Skip = map[string]bool{}
+	job.Stale = map[string]bool{}
+	skip := func(file *utils.PFile, path string) {
+		if !job.Skip[path] {
+			job.Skip[path] = true
+			job.Skipped.Inc()
+			appData.Metrics.FilesSkipped.Inc()
+			appData.Stats.TotalFiles.Dec()
+			appData.Stats.TotalBytes.Sub(uint64(file.Size.Load()))
+		}
+	}
+
+	now := time.Now()
+	unselected := 0
+	utils.WalkFiles(job.Directory, func(file *utils.PFile) {
+		if !appData.Selector.Match(file, now) {
+			skip(file, job.Dest.Path(file))
+			unselected++
+		}
+	})
+	if unselected > 0 {
+		appData.BLog.Infof("Skipping %d files that are outside of the size and age limits", unselected)
+	}
+
+	if job.Previous != nil {
+		// Watch mode, only what changed since the last crawl and what an earlier pass didn't get to
+		changed := utils.ChangedFiles(job.Previous, job.Directory)
+		unchanged := 0
+		utils.WalkFiles(job.Directory, func(file *utils.PFile) {
+			path := job.Dest.Path(file)
+			if changed[file.GetFullPath()] == nil && !job.Retry[path] && !job.Skip[path] {
+				skip(file, path)
+				unchanged++
+			}
+		})
+		appData.BLog.Infof("Skipping %d files of %s that didn't change since the last crawl", unchanged, job.Name())
+	}
+
+	if appData.Cfg.Force {
+		return nil
+	}
+
+	localDir, err := job.BuildLocalTree()
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing downloaded yet
+			return nil
+		}
+		return fmt.Errorf("job.BuildLocalTree: %w", err)
+	}
+
+	report := utils.CompareLocalToRemote(appData.BLog, localDir, job.Directory, job.Dest.LocalRoot())
+	stateChanged := false
+	complete := 0
+	for _, diff := range report.Files {
+		if diff.Status != utils.DiffMatched && diff.Status != utils.DiffNewerOnRemote {
+			continue
+		}
+		file := diff.Remote
+		path := job.Dest.Path(file)
+		if job.State.Changed(file, path) {
+			// Same size but the remote file got replaced, download it again
+			job.Stale[path] = true
+			continue
+		}
+		if !job.State.IsSynced(file, path) {
+			if diff.Status == utils.DiffNewerOnRemote {
+				// Unknown to the state and the remote copy is newer than ours
+				job.Stale[path] = true
+				continue
+			}
+			// Complete on disk but unknown to the state, a previous run was interrupted before recording it
+			err = job.State.Add(file, path, "")
+			if err != nil {
+				appData.BLog.Warnf("Failed to record complete file in sync state: %s", err.Error())
+			}
+			stateChanged = true
+		}
+		skip(file, path)
+		complete++
+	}
+	if stateChanged {
+		err = job.State.Save()
+		if err != nil {
+			return fmt.Errorf("job.State.Save: %w", err)
+		}
+	}
+	appData.BLog.Infof("Skipping %d files of %s that are already complete on disk", complete, job.Name())
+	return nil
+}
+
+// verify rehashes the synced files against the sync state, with -requeue the corrupted ones are deleted so the sync downloads them again
+func verify(appData *app.App, job *app.SyncJob) bool {
+	report := job.State.Verify()
+	for _, path := range report.Corrupted {
+		msg := fmt.Sprintf("Corrupted: %s", path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Warn(msg)
+		if appData.Cfg.Requeue {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				appData.BLog.Errorf("Failed to remove corrupted file %s: %s", path, err.Error())
+				continue
+			}
+			job.State.Forget(path)
+		}
+	}
+	for _, path := range report.Missing {
+		msg := fmt.Sprintf("Missing: %s", path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Warn(msg)
+		if appData.Cfg.Requeue {
+			job.State.Forget(path)
+		}
+	}
+	msg := fmt.Sprintf("Verify of %s finished: %d verified, %d corrupted, %d missing, %d hashed for the first time", job.Name(), len(report.Verified), len(report.Corrupted), len(report.Missing), len(report.Hashed))
+	if !appData.Cfg.Daemon {
+		fmt.Println(msg)
+	}
+	appData.BLog.Info(msg)
+
+	err := job.State.Save()
+	if err != nil {
+		appData.BLog.Errorf("Failed to save sync state: %s", err.Error())
+	}
+	return report.OK()
+}
+
+// mirror removes the local files and empty folders that no longer exist on the cloud
+func mirror(appData *app.App, job *app.SyncJob) {
+	localDir, err := job.BuildLocalTree()
+	if err != nil {
+		msg := fmt.Sprintf("An error occurred while analyzing local filesystem: %s", err.Error())
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Error(msg)
+		return
+	}
+
+	// Our own files end up in the synced folder with something like -strip-root -dest .
+	keep := []string{job.State.Location, job.State.Location + ".tmp", appData.LogPath, ".env"}
+	if len(appData.Cfg.HealthPath) > 0 {
+		keep = append(keep, appData.Cfg.HealthPath, appData.Cfg.HealthPath+".tmp")
+	}
+	opts := utils.MirrorOptions{
+		DryRun:       appData.Cfg.DryRun,
+		MaxDeletions: appData.Cfg.MaxDeletions,
+		TrashDir:     appData.Cfg.TrashDir,
+		Recursive:    appData.Cfg.Recursive,
+	}
+	for _, path := range keep {
+		if len(path) > 0 {
+			path, _ = filepath.Abs(path)
+			opts.Keep = append(opts.Keep, path)
+		}
+	}
+	report, err := utils.MirrorLocal(appData.BLog, localDir, job.Directory, opts)
+	if err != nil {
+		msg := fmt.Sprintf("Mirror aborted: %s", err.Error())
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Error(msg)
+		return
+	}
+
+	for _, warning := range report.Warnings {
+		msg := fmt.Sprintf("Mirror: %s", warning)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Warn(msg)
+	}
+	verb := "Removed"
+	if appData.Cfg.DryRun {
+		verb = "Would remove"
+	}
+	// With -daemon stdout only carries events
+	for _, path := range report.Files {
+		msg := fmt.Sprintf("%s: %s", verb, path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Info(msg)
+	}
+	for _, path := range report.Directories {
+		msg := fmt.Sprintf("%s folder: %s", verb, path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Info(msg)
+	}
+	appData.BLog.Infof("Mirror: %d files and %d folders of %s affected", len(report.Files), len(report.Directories), job.Name())
+}
+
+// printSummary prints what every job did during the run, returns false if any file failed
+func printSummary(appData *app.App) bool {
+	ok := true
+	for _, job := range appData.Jobs {
+		failures := job.Failures.List()
+		msg := fmt.Sprintf("%s: %d files downloaded (%s), %d skipped, %d cancelled, %d failed", job.Name(), job.Downloaded.Load(), humanize.Bytes(uint64(job.DownloadedBytes.Load())), job.Skipped.Load(), job.Cancelled.Load(), len(failures))
+		if !appData.Cfg.Daemon {
+			// The daemon gets the summary as sync_finished event
+			fmt.Println(msg)
+		}
+		appData.BLog.Info(msg)
+		for _, failure := range failures {
+			msg = fmt.Sprintf("%s (%d attempts): %s", failure.Path, failure.Attempts, failure.Error)
+			if !appData.Cfg.Daemon {
+				fmt.Println(msg)
+			}
+			appData.BLog.Error(msg)
+		}
+		if len(failures) > 0 {
+			ok = false
 		}
 	}
+	return ok
 }
 
 func main() {
+	// Registered first so it runs last, after the other deferred cleanups
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	appData, err := app.NewApp()
 	if err != nil {
 		panic(err)
 	}
+	// Runs the cleanups, like removing the lockfiles, unless a signal already had to
+	defer appData.Shutdown.Close()
 
 	versionOutput := appData.VersionRoutine()
 	if appData.Cfg.Version {
@@ -92,66 +358,375 @@ func main() {
 	}
 	appData.BLog.Debug(versionOutput)
 
-	folderHash := hex.EncodeToString([]byte(appData.Cfg.Folder))
-	folderLockfile := folderHash + ".lock"
+	if len(appData.Jobs) == 0 {
+		msg := "No folder to sync, use -folder"
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Error(msg)
+		os.Exit(-1)
+	}
+
 	if !appData.Cfg.IgnoreParallel {
-		_, err = os.Stat(folderLockfile)
-		if err == nil {
-			fmt.Println("There is already a sync in progress for this folder.")
-			appData.BLog.Warn("There is already a sync in progress for this folder.")
-			os.Exit(0)
-		} else {
-			if os.IsNotExist(err) {
-				// Continue
-				lockFile, err := os.Create(folderLockfile)
-				if err != nil {
-					// Error out
-					msg := fmt.Sprintf("An error occurred while creating the lockfile: %s", err.Error())
-					fmt.Println(msg)
-					appData.BLog.Error(msg)
-					os.Exit(-1)
+		host, _ := os.Hostname()
+		for _, job := range appData.Jobs {
+			info := utils.LockInfo{PID: os.Getpid(), Host: host, Started: time.Now(), Version: app.AppVersion, Folder: job.Folder}
+			lock, err := utils.AcquireLock(utils.LockFilePath(job.DestRoot, job.Folder), info, appData.Cfg.LockTimeout)
+			if err != nil {
+				if errors.Is(err, utils.ErrLocked) {
+					msg := fmt.Sprintf("There is already a sync in progress for %s: %s", job.Name(), err.Error())
+					if !appData.Cfg.Daemon {
+						fmt.Println(msg)
+					}
+					appData.BLog.Warn(msg)
+					return
 				}
-				lockFile.Close()
-				defer os.Remove(folderLockfile)
-			} else {
 				// Error out
-				msg := fmt.Sprintf("An error occurred while checking for the lockfile: %s", err.Error())
-				fmt.Println(msg)
+				msg := fmt.Sprintf("An error occurred while creating the lockfile: %s", err.Error())
+				if !appData.Cfg.Daemon {
+					fmt.Println(msg)
+				}
 				appData.BLog.Error(msg)
-				os.Exit(-1)
+				exitCode = -1
+				return
 			}
+			appData.Shutdown.OnExit(func() {
+				err := lock.Release()
+				if err != nil {
+					appData.BLog.Warnf("Failed to release the lock of %s: %s", job.Name(), err.Error())
+				}
+			})
+		}
+	}
+
+	if len(appData.Cfg.Listen) > 0 {
+		err = appData.Serve()
+		if err != nil {
+			msg := fmt.Sprintf("An error occurred while starting the API: %s", err.Error())
+			if !appData.Cfg.Daemon {
+				fmt.Println(msg)
+			}
+			appData.BLog.Error(msg)
+			exitCode = -1
+			return
+		}
+	}
+
+	err = crawlJobs(appData)
+	if err != nil {
+		msg := fmt.Sprintf("An error occurred while crawling: %s", err.Error())
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
 		}
+		appData.BLog.Error(msg)
+		exitCode = -1
+		return
 	}
 
-	appData.Directory = utils.LocateDirectory(appData.Client, appData.Cfg.Folder, appData.Cfg.Recursive)
-	if appData.Directory == nil {
-		// can't get dir
-		panic("dir is nil")
+	if appData.Cfg.Verify {
+		ok := true
+		for _, job := range appData.Jobs {
+			if !verify(appData, job) {
+				ok = false
+			}
+		}
+		if !appData.Cfg.Requeue {
+			if !ok {
+				exitCode = 1
+			}
+			return
+		}
 	}
-	appData.Stats.TotalFiles.Store(uint64(appData.Directory.FileCount.Load()))
-	appData.Stats.TotalBytes.Store(uint64(appData.Directory.TotalSize.Load()))
-	appData.BLog.Infof("Crawled dir: %s with a total of %d files found (%s)", appData.Directory.Name.Load(), appData.Directory.FileCount.Load(), humanize.Bytes(uint64(appData.Directory.TotalSize.Load())))
 
 	if appData.Cfg.OutputAnalysis || appData.Cfg.Repair {
-		localDir := &utils.PDirectory{}
-		localDir, err = utils.BuildDirectoryTree(appData.Directory.Name.Load())
-		if err != nil {
-			msg := fmt.Sprintf("An error occurred while analyzing local filesystem: %s", err.Error())
+		for _, job := range appData.Jobs {
+			localDir := &utils.PDirectory{}
+			localDir, err = job.BuildLocalTree()
+			if err != nil {
+				if !os.IsNotExist(err) {
+					msg := fmt.Sprintf("An error occurred while analyzing local filesystem: %s", err.Error())
+					if !appData.Cfg.Daemon {
+						fmt.Println(msg)
+					}
+					appData.BLog.Error(msg)
+					exitCode = -1
+					return
+				}
+				// Nothing downloaded yet, everything is missing locally
+				localDir = &utils.PDirectory{}
+			}
+
+			report := utils.CompareLocalToRemote(appData.BLog, localDir, job.Directory, job.Dest.LocalRoot())
+			if appData.Cfg.OutputAnalysis {
+				if len(appData.Jobs) > 1 && appData.Cfg.Format == utils.ReportFormatTable {
+					fmt.Println(fmt.Sprintf("== %s ==", job.Name()))
+				}
+				err = utils.WriteReport(os.Stdout, report, appData.Cfg.Format)
+				if err != nil {
+					msg := fmt.Sprintf("An error occurred while writing the analysis: %s", err.Error())
+					if !appData.Cfg.Daemon {
+						fmt.Println(msg)
+					}
+					appData.BLog.Error(msg)
+					exitCode = -1
+					return
+				}
+			}
+			if appData.Cfg.Repair {
+				// Repair by resuming PARTIAL files and removing OVERSIZED files, files missing in remote are ignored and files missing locally are not an error
+				refresh := func(file *utils.PFile) error {
+					err := utils.RefreshLink(appData.Client, file)
+					if err == nil {
+						appData.Metrics.LinkRefreshes.Inc()
+					}
+					return err
+				}
+				repairReport := utils.RepairMismatches(appData.Shutdown.Aborted, appData.BLog, appData.DownloadClient, refresh, report)
+				// With -daemon stdout only carries events
+				msg := fmt.Sprintf("Repair of %s finished: %d resumed, %d deleted, %d untouched", job.Name(), len(repairReport.Resumed), len(repairReport.Deleted), len(repairReport.Untouched))
+				if !appData.Cfg.Daemon {
+					fmt.Println(msg)
+				}
+				appData.BLog.Info(msg)
+				for _, path := range repairReport.Resumed {
+					msg = "Resumed: " + path
+					if !appData.Cfg.Daemon {
+						fmt.Println(msg)
+					}
+					appData.BLog.Info(msg)
+				}
+				for _, path := range repairReport.Deleted {
+					msg = "Deleted: " + path
+					if !appData.Cfg.Daemon {
+						fmt.Println(msg)
+					}
+					appData.BLog.Info(msg)
+				}
+			}
+			if appData.Cfg.OutputAnalysis && !report.OK() {
+				exitCode = 1
+			}
+		}
+		return
+	}
+
+	if appData.Cfg.Move && !confirmMove(appData) {
+		msg := "-move was not confirmed, run it on a terminal or add -confirm-move"
+		if !appData.Cfg.Daemon {
 			fmt.Println(msg)
-			appData.BLog.Error(msg)
-			os.Exit(-1)
 		}
+		appData.BLog.Error(msg)
+		exitCode = -1
+		return
+	}
+
+	if appData.Cfg.Watch > 0 {
+		watch(appData)
+		appData.BLog.Info("Stopping program")
+		return
+	}
+
+	ok, err := syncJobs(appData)
+	if err != nil {
+		msg := fmt.Sprintf("An error occurred while syncing: %s", err.Error())
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Error(msg)
+		exitCode = -1
+		return
+	}
+	if !ok {
+		exitCode = 1
+	}
+	if appData.Shutdown.Stopping.Err() != nil {
+		// Interrupted, the sync is not complete
+		exitCode = 130
+	}
+	appData.BLog.Info("Stopping program")
+	return
+}
+
+// move deletes the files that were downloaded and verified from the cloud, together with the folders that become empty.
+// Besides this pass' downloads that includes the files an earlier run downloaded and verified, which were skipped because they are complete on disk.
+// A hash in the state alone is not enough, -verify and -rebuildstate also store one for files we never downloaded.
+func move(appData *app.App, job *app.SyncJob) {
+	verified := map[string]bool{}
+	now := time.Now()
+	utils.WalkFiles(job.Directory, func(file *utils.PFile) {
+		if appData.Selector.Match(file, now) && job.State.IsDownloaded(file, job.Dest.Path(file)) {
+			verified[file.ID.Load()] = true
+		}
+	})
+	for file, path := range job.Verified.List() {
+		// Something like -trash or the user could have touched it since, it has to still be there
+		info, err := os.Stat(path)
+		if err != nil || info.Size() != file.Size.Load() {
+			appData.BLog.Warnf("Move: keeping %s on the cloud, the local file changed since it was verified", file.GetFullPath())
+			continue
+		}
+		verified[file.ID.Load()] = true
+	}
+	if len(verified) == 0 {
+		return
+	}
+
+	report := utils.MoveRemote(appData.Shutdown.Aborted, appData.Client, job.Directory, verified, appData.Cfg.DryRun)
+	verb := "Deleted from Premiumize"
+	if appData.Cfg.DryRun {
+		verb = "Would delete from Premiumize"
+	} else {
+		job.Moved.Add(int64(len(report.Files)))
+		appData.Metrics.FilesMoved.Add(uint64(len(report.Files)))
+	}
+	// With -daemon stdout only carries events
+	for _, path := range report.Files {
+		msg := fmt.Sprintf("%s: %s", verb, path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Info(msg)
+	}
+	for _, path := range report.Directories {
+		msg := fmt.Sprintf("%s folder: %s", verb, path)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Info(msg)
+	}
+	for _, failure := range report.Errors {
+		msg := fmt.Sprintf("Move failed, kept on Premiumize: %s", failure)
+		if !appData.Cfg.Daemon {
+			fmt.Println(msg)
+		}
+		appData.BLog.Error(msg)
+	}
+	appData.BLog.Infof("Move: %d files and %d folders of %s affected, %d errors", len(report.Files), len(report.Directories), job.Name(), len(report.Errors))
+}
+
+// confirmMove asks on the terminal before -move deletes anything from the cloud, without a terminal -confirm-move is required
+func confirmMove(appData *app.App) bool {
+	if appData.Cfg.ConfirmMove || appData.Cfg.DryRun {
+		return true
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 || appData.Cfg.Daemon {
+		return false
+	}
+	files, size := int64(0), int64(0)
+	for _, job := range appData.Jobs {
+		files += job.Directory.FileCount.Load()
+		size += job.Directory.TotalSize.Load()
+	}
+	fmt.Printf("-move deletes every file from Premiumize once it is downloaded and verified, up to %d files (%s). Type yes to continue: ", files, humanize.Bytes(uint64(size)))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.EqualFold(strings.TrimSpace(answer), "yes")
+}
+
+// flushState saves the sync state of every job after an abort, the part files of the cancelled downloads stay on disk to be resumed
+func flushState(appData *app.App) {
+	for _, job := range appData.Jobs {
+		if job.State == nil {
+			continue
+		}
+		err := job.State.Save()
+		if err != nil {
+			appData.BLog.Errorf("Failed to save the sync state of %s: %s", job.Name(), err.Error())
+		}
+	}
+}
+
+// crawlJobs crawls the remote folder of every job and adds it to the totals, the previous tree is kept as snapshot for watch mode.
+// The jobs are only updated once every folder was crawled, so a failed crawl leaves all snapshots alone.
+func crawlJobs(appData *app.App) error {
+	directories := make([]*utils.PDirectory, len(appData.Jobs))
+	for i, job := range appData.Jobs {
+		if appData.Shutdown.Stopping.Err() != nil {
+			return fmt.Errorf("stopped before crawling %s: %w", job.Folder, appData.Shutdown.Stopping.Err())
+		}
+		start := time.Now()
+		appData.Events.Emit(app.EventCrawlStarted, &app.CrawlStartedEvent{Folder: job.Folder})
+		directory, err := utils.LocateDirectory(appData.Client, job.Folder, utils.CrawlOptions{Recursive: appData.Cfg.Recursive, Depth: appData.Cfg.Depth, Filter: job.Filter})
+		if err != nil {
+			return fmt.Errorf("utils.LocateDirectory: %w", err)
+		}
+		appData.Metrics.ObserveCrawl(job.Folder, time.Since(start))
+		appData.Events.Emit(app.EventCrawlFinished, &app.CrawlFinishedEvent{Folder: job.Folder, Files: directory.FileCount.Load(), Bytes: directory.TotalSize.Load(), Duration: time.Since(start).Seconds()})
+		directories[i] = directory
+	}
+
+	for i, job := range appData.Jobs {
+		job.SetDirectory(directories[i])
+		if job.State == nil {
+			job.Dest = utils.NewDestination(job.DestRoot, appData.Cfg.StripRoot, job.Directory.Name.Load())
+			err := appData.SetupState(job)
+			if err != nil {
+				return fmt.Errorf("appData.SetupState: %w", err)
+			}
+		}
+		appData.Stats.TotalFiles.Add(uint64(job.Directory.FileCount.Load()))
+		appData.Stats.TotalBytes.Add(uint64(job.Directory.TotalSize.Load()))
+		appData.BLog.Infof("Crawled dir: %s with a total of %d files found (%s)", job.Directory.Name.Load(), job.Directory.FileCount.Load(), humanize.Bytes(uint64(job.Directory.TotalSize.Load())))
+	}
+	return nil
+}
 
-		// Repair by removing PARTIAL and OVERSIZED files, files missing in remote are ignored and files missing locally are not an error
-		_ = utils.CompareLocalToRemote(appData.BLog, localDir, appData.Directory, appData.Cfg.Repair)
+// tick updates the tracker and shows the progress, as text or as file_progress events with -daemon
+func tick(appData *app.App, term *bunterm.BunTerminal, clear bool) {
+	if appData.Cfg.Daemon {
+		// Before the tick, it resets the deltas the speed is based on
+		progressEvents(appData)
+		_ = appData.Stats.Tick(false)
 		return
 	}
+	if clear {
+		// Human-readable means we clear the spam
+		term.ClearTerminal()
+		term.MoveCursor(0, 0)
+	}
+	fmt.Println(appData.Stats.Tick(true))
+}
+
+func progressEvents(appData *app.App) {
+	elapsed := time.Since(appData.Stats.LastTick.Load()).Seconds()
+	appData.Stats.Tasks.Range(func(location string, task gokhttp_download.DownloadTask) bool {
+		threaded, ok := task.(*gokhttp_download.ThreadedDownloadTask)
+		if !ok {
+			return true
+		}
+		speed := int64(0)
+		if elapsed > 0 {
+			speed = int64(float64(threaded.TaskStats.DeltaBytes.Load()) / elapsed)
+		}
+		appData.Events.Emit(app.EventFileProgress, &app.FileProgressEvent{
+			Path:       strings.TrimSuffix(location, utils.PartSuffix),
+			Size:       int64(threaded.TaskStats.FileSize.Load()),
+			Downloaded: int64(threaded.TaskStats.DownloadedBytes.Load()),
+			Speed:      speed,
+		})
+		return true
+	})
+}
+
+// syncJobs downloads the crawled jobs until the tracker stops, prints the summary and mirrors the jobs without failures, returns false if any file failed
+func syncJobs(appData *app.App) (bool, error) {
+	for _, job := range appData.Jobs {
+		err := planDownloads(appData, job)
+		if err != nil {
+			return false, fmt.Errorf("planDownloads of %s: %w", job.Name(), err)
+		}
+	}
+	queued := int64(0)
+	for _, job := range appData.Jobs {
+		queued += job.Directory.FileCount.Load() - job.Skipped.Load()
+	}
+	appData.Metrics.QueueDepth.Store(queued)
 
 	// UI
 	go func() {
 		appData.BLog.Debug("Starting the UI thread")
-		fmt.Println(appData.Stats.Tick(true))
 		term := bunterm.DefaultTerminal
+		tick(appData, term, false)
 		for {
 			if appData.Stats.GraceFulStop.Load() || appData.Stats.IdleTimeoutExceeded() {
 				if appData.Stats.GraceFulStop.Load() {
@@ -162,20 +737,25 @@ func main() {
 				appData.Stats.Stop()
 				break
 			}
-			if !appData.Cfg.Daemon {
-				// Human-readable means we clear the spam
-				term.ClearTerminal()
-				term.MoveCursor(0, 0)
+			if appData.Control.Paused() {
+				// Paused is not idle, don't let us time out
+				appData.Stats.IdleSince.Store(time.Time{})
 			}
-			fmt.Println(appData.Stats.Tick(true))
+			tick(appData, term, true)
 			time.Sleep(time.Second)
 		}
 		appData.BLog.Debug("Stopping the UI thread")
 	}()
 
-	errGr, ctx := errgroup.WithContext(context.Background())
-	workChan := make(chan *gokhttp_download.ThreadedDownloadTask, appData.Cfg.DownloadThreads-1)
-	for i := 1; i <= appData.Cfg.DownloadThreads; i++ {
+	// All jobs share the workers and the tracker, so -threads is a global limit
+	errGr, ctx := errgroup.WithContext(appData.Shutdown.Aborted)
+	workers := appData.Cfg.DownloadThreads
+	if len(appData.Cfg.Listen) > 0 {
+		// The API can raise the thread count while we are running
+		workers = app.MaxThreads
+	}
+	workChan := make(chan *Job, workers-1)
+	for i := 1; i <= workers; i++ {
 		threadId := i
 		errGr.Go(func() error {
 			return Worker(ctx, threadId, workChan, appData)
@@ -183,54 +763,69 @@ func main() {
 	}
 
 	appData.BLog.Debugf("Going to start download loop")
-	go downloadLoop(appData, nil, workChan)
-	err = errGr.Wait()
+	// The first signal only stops enqueueing, the tracker's graceful stop would close the running downloads so it waits for the workers
+	loopCtx, stopLoop := context.WithCancel(ctx)
+	defer stopLoop()
+	context.AfterFunc(appData.Shutdown.Stopping, stopLoop)
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		for _, job := range appData.Jobs {
+			if appData.Stats.GraceFulStop.Load() || loopCtx.Err() != nil {
+				break
+			}
+			downloadLoop(loopCtx, appData, job, nil, workChan)
+		}
+	}()
+	go func() {
+		<-loopDone
+		select {
+		case <-appData.Shutdown.Stopping.Done():
+			// Nothing is sent anymore, the workers stop once the running downloads are done
+			close(workChan)
+		case <-ctx.Done():
+		}
+	}()
+	err := errGr.Wait()
 	if err != nil {
 		appData.BLog.Error(err)
-		<-workChan // unlock looper
 	}
+	// Wait cancels ctx, a loop that is still waiting for a worker gives up
+	<-loopDone
 	appData.BLog.Info("Waiting for all threads to end")
 	appData.Stats.Stop()
-	appData.BLog.Info("Stopping program")
-	return
-}
+	if appData.Shutdown.Aborted.Err() != nil {
+		flushState(appData)
+	}
 
-func Worker(ctx context.Context, threadId int, workChan chan *gokhttp_download.ThreadedDownloadTask, appData *app.App) error {
-	appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker starting", threadId))
-	ticker := time.NewTicker(time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			break
-		case task := <-workChan:
-			if task == nil {
+	if appData.Cfg.Move && appData.Shutdown.Aborted.Err() == nil {
+		for _, job := range appData.Jobs {
+			move(appData, job)
+		}
+	}
+
+	ok := printSummary(appData)
+	summary := &app.SyncFinishedEvent{Stopped: appData.Shutdown.Stopping.Err() != nil, Jobs: appData.JobStatuses()}
+	appData.Events.Emit(app.EventSyncFinished, summary)
+	// Like -move, an aborted run leaves the local files alone
+	if err == nil && appData.Cfg.Mirror && appData.Shutdown.Aborted.Err() == nil {
+		for _, job := range appData.Jobs {
+			if len(job.Failures.List()) > 0 {
+				appData.BLog.Warnf("Mirror: skipping %s because some of its files failed to download", job.Name())
 				continue
-			} else {
-				appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker downloading: %s", threadId, task.FileLocation.Load()))
-				// Blocking
-				err := task.Download(ctx)
-				if err != nil {
-					appData.BLog.Error(fmt.Sprintf("[thread:%d] Worker stopping: %s", threadId, err.Error()))
-					appData.BLog.Debug(fmt.Sprintf("[thread:%d] Task: %s", threadId, TaskJSON(task)))
-					return fmt.Errorf("[thread:%d] task.Download: %w", threadId, err)
-				}
 			}
-			break
-		}
-		if appData.Stats.GraceFulStop.Load() {
-			appData.BLog.Info(fmt.Sprintf("[thread:%d] Worker stopping - Graceful stop", threadId))
-			break
+			mirror(appData, job)
 		}
 	}
-	appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker stopping", threadId))
-	return nil
-}
 
-func TaskJSON(task *gokhttp_download.ThreadedDownloadTask) string {
-	jsonBytes, err := json.Marshal(task)
-	if err != nil {
-		return ""
+	// The sync hooks come last, after the file hooks and the mirror
+	appData.Hooks.Wait()
+	status := app.SyncStatusOK
+	if summary.Stopped {
+		status = app.SyncStatusStopped
+	} else if !ok {
+		status = app.SyncStatusFailed
 	}
-
-	return string(jsonBytes)
+	appData.Hooks.OnSyncDone(appData.Shutdown.Aborted, status, summary)
+	return ok, nil
 }
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// SplitCommand splits a command line into its arguments like a shell would, without running a shell.
+// Single quotes keep everything literally and double quotes work like in sh, a backslash only escapes whitespace,
+// quotes and backslashes so Windows paths like C:\tools\notify.exe don't need quoting.
+func SplitCommand(command string) ([]string, error) {
+	args := []string{}
+	current := strings.Builder{}
+	inArg := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			current.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inArg = true
+		case c == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte(`"\$`+"`", command[i+1]) >= 0 {
+					i++
+				}
+				current.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inArg = true
+		case c == '\\' && i+1 < len(command) && strings.IndexByte(" \t\n'\"\\", command[i+1]) >= 0:
+			i++
+			current.WriteByte(command[i])
+			inArg = true
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// ExpandCommand replaces the {placeholders} in every argument, values never split into more arguments so they can't inject anything
+func ExpandCommand(args []string, values map[string]string) []string {
+	pairs := make([]string, 0, len(values)*2)
+	for key, value := range values {
+		pairs = append(pairs, "{"+key+"}", value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = replacer.Replace(arg)
+	}
+	return result
+}
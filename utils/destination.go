@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Destination maps the crawled remote tree onto the local filesystem
+type Destination struct {
+	// Local directory the mirror lives in.
+	Root string
+	// Whether the top remote folder is left out, putting its content straight into Root.
+	StripRoot bool
+	// Name of the top remote folder.
+	RemoteRoot string
+}
+
+func NewDestination(root string, stripRoot bool, remoteRoot string) Destination {
+	if len(root) == 0 {
+		root = "."
+	}
+	return Destination{Root: root, StripRoot: stripRoot, RemoteRoot: remoteRoot}
+}
+
+// LocalRoot returns the local directory that corresponds to the top remote folder
+func (d Destination) LocalRoot() string {
+	if d.StripRoot {
+		return filepath.Clean(d.Root)
+	}
+	return filepath.Join(d.Root, d.RemoteRoot)
+}
+
+// Path returns where a remote file is stored locally
+func (d Destination) Path(file *PFile) string {
+	rel := strings.TrimPrefix(file.GetFullPath(), d.RemoteRoot)
+	return filepath.Join(d.LocalRoot(), filepath.FromSlash(rel))
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/BRUHItsABunny/gOkHttp/requests"
+)
+
+// ResumeFile appends the missing bytes of a partially downloaded file using a byte-range request against the file's link.
+// If the server ignores the range the file is downloaded again from scratch.
+func ResumeFile(ctx context.Context, hClient *http.Client, file *PFile, localPath string) (int64, error) {
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("f.Stat: %w", err)
+	}
+	offset := info.Size()
+	remoteSize := file.Size.Load()
+	if offset >= remoteSize {
+		return 0, fmt.Errorf("nothing to resume, local size %d and remote size %d", offset, remoteSize)
+	}
+
+	req, err := gokhttp_requests.MakeGETRequest(ctx, file.Link.Load())
+	if err != nil {
+		return 0, fmt.Errorf("requests.MakeGETRequest: %w", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := hClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("hClient.Do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start)
+		if err == nil && start != offset {
+			return 0, fmt.Errorf("range starts at %d instead of %d", start, offset)
+		}
+	case http.StatusOK:
+		// Range not honoured, we are getting the whole file
+		err = f.Truncate(0)
+		if err != nil {
+			return 0, fmt.Errorf("f.Truncate: %w", err)
+		}
+	default:
+		return 0, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	written, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return written, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	info, err = f.Stat()
+	if err != nil {
+		return written, fmt.Errorf("f.Stat: %w", err)
+	}
+	if info.Size() != remoteSize {
+		return written, fmt.Errorf("size after resume is %d instead of %d", info.Size(), remoteSize)
+	}
+	return written, nil
+}
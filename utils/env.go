@@ -1,16 +1,21 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"os"
+
 	"github.com/joho/godotenv"
 )
 
+// LoadEnv loads the .env file in the working directory into the environment, variables that are already set win and a missing file is not an error
 func LoadEnv() error {
 	err := godotenv.Load(".env")
 	if err != nil {
-		fmt.Println("INFO: Failed to load .env")
-	} else {
-		fmt.Println("INFO: Loaded .env")
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("godotenv.Load: %w", err)
 	}
-	return err
+	return nil
 }
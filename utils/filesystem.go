@@ -1,16 +1,27 @@
 package utils
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/BRUHItsABunny/bunnlog"
 	"go.uber.org/atomic"
 )
 
+// PartSuffix is appended to files while they are being downloaded, they are renamed once complete
+const PartSuffix = ".part"
+
+// PartPath returns where the file at path lives while it is being downloaded
+func PartPath(path string) string {
+	return path + PartSuffix
+}
+
 func BuildDirectoryTree(rootPath string) (*PDirectory, error) {
 	abs, err := filepath.Abs(rootPath)
 	if err != nil {
@@ -34,6 +45,7 @@ func buildDir(dirPath string) (*PDirectory, error) {
 		Name:        atomic.NewString(filepath.Base(dirPath)),
 		Directories: make(map[string]*PDirectory, 8),
 		Files:       make(map[string]*PFile, 32),
+		Partials:    make(map[string]*PFile),
 		TotalSize:   atomic.NewInt64(0),
 		FileCount:   atomic.NewInt64(0),
 	}
@@ -50,6 +62,10 @@ func buildDir(dirPath string) (*PDirectory, error) {
 		if e.Type()&fs.ModeSymlink != 0 {
 			continue
 		}
+		if strings.HasPrefix(name, bookkeepingPrefix) || name == IgnoreFileName {
+			// Our own bookkeeping, not part of the synced files
+			continue
+		}
 
 		if e.IsDir() {
 			child, err := buildDir(full)
@@ -74,6 +90,14 @@ func buildDir(dirPath string) (*PDirectory, error) {
 				Path: atomic.NewString(full),
 				Name: atomic.NewString(name),
 				Size: atomic.NewInt64(size),
+				// No portable creation time for local files, the last write is what we compare against anyway
+				Created: atomic.NewTime(fi.ModTime()),
+			}
+			if strings.HasSuffix(name, PartSuffix) {
+				// Unfinished download, doesn't count towards the totals
+				pf.Name.Store(strings.TrimSuffix(name, PartSuffix))
+				d.Partials[pf.Name.Load()] = pf
+				continue
 			}
 			d.Files[name] = pf
 			d.TotalSize.Add(size)
@@ -85,70 +109,177 @@ func buildDir(dirPath string) (*PDirectory, error) {
 }
 
 type SizeMismatch struct {
+	Path       string `json:"path"`
+	LocalSize  int64  `json:"localSize"`
+	RemoteSize int64  `json:"remoteSize"`
+	Remote     *PFile `json:"-"`
+}
+
+type DiffStatus string
+
+const (
+	DiffMatched         DiffStatus = "matched"
+	DiffMissingLocally  DiffStatus = "missing_locally"
+	DiffMissingInRemote DiffStatus = "missing_in_remote"
+	DiffSizeMismatch    DiffStatus = "size_mismatch"
+	DiffNewerOnRemote   DiffStatus = "newer_on_remote"
+)
+
+type FileDiff struct {
 	Path       string
+	Status     DiffStatus
 	LocalSize  int64
 	RemoteSize int64
+	Remote     *PFile // nil when missing in remote
+}
+
+// DirectoryRollup sums up the files and bytes per status of a directory and all of its subdirectories.
+type DirectoryRollup struct {
+	Files map[DiffStatus]int   `json:"files"`
+	Bytes map[DiffStatus]int64 `json:"bytes"`
 }
 
 type DiffReport struct {
 	// Files present locally but not in the matching remote directory.
-	MissingInRemote []string
+	MissingInRemote []string `json:"missingInRemote"`
+	// Files present remotely but not in the matching local directory.
+	MissingLocally []string `json:"missingLocally"`
 	// Files present in both but with different sizes.
-	SizeMismatches []SizeMismatch
+	SizeMismatches []SizeMismatch `json:"sizeMismatches"`
+	// Files present in both with equal size but created on the remote after the local copy was last written.
+	NewerOnRemote []string `json:"newerOnRemote"`
+	// Unfinished downloads, Path is the name they get once complete and Remote is nil if the file no longer exists remotely.
+	PartialFiles []SizeMismatch `json:"partialFiles"`
+	// Remote directories that were not crawled because of the depth limit, their contents are not compared.
+	Truncated []string `json:"truncated"`
+
+	// Every file that was compared, regardless of status.
+	Files []FileDiff `json:"-"`
+	// Rollups keyed by relative directory path, the root directory holds the totals.
+	Directories map[string]*DirectoryRollup `json:"directories"`
 
 	// Stats
-	MatchedCount int // files present in both with equal size
-	CheckedCount int // files present in both (matched or mismatched)
+	MatchedCount int `json:"matchedCount"` // files present in both with equal size
+	CheckedCount int `json:"checkedCount"` // files present in both (matched or mismatched)
 }
 
-// OK returns true if there are no missing files on remote and no size mismatches.
+// OK returns true if the local copy matches the remote, every difference counts. Truncated directories were not compared, so they don't.
 func (r DiffReport) OK() bool {
-	return len(r.MissingInRemote) == 0 && len(r.SizeMismatches) == 0
+	return len(r.MissingInRemote) == 0 && len(r.MissingLocally) == 0 && len(r.SizeMismatches) == 0 && len(r.NewerOnRemote) == 0 && len(r.PartialFiles) == 0
+}
+
+func (r *DiffReport) add(root string, diff FileDiff) {
+	r.Files = append(r.Files, diff)
+	switch diff.Status {
+	case DiffMatched:
+		r.MatchedCount++
+		r.CheckedCount++
+	case DiffNewerOnRemote:
+		r.NewerOnRemote = append(r.NewerOnRemote, diff.Path)
+		r.CheckedCount++
+	case DiffSizeMismatch:
+		r.SizeMismatches = append(r.SizeMismatches, SizeMismatch{
+			Path: diff.Path, LocalSize: diff.LocalSize, RemoteSize: diff.RemoteSize, Remote: diff.Remote,
+		})
+		r.CheckedCount++
+	case DiffMissingLocally:
+		r.MissingLocally = append(r.MissingLocally, diff.Path)
+	case DiffMissingInRemote:
+		r.MissingInRemote = append(r.MissingInRemote, diff.Path)
+	}
+
+	size := diff.RemoteSize
+	if diff.Status == DiffMissingInRemote {
+		size = diff.LocalSize
+	}
+	// Roll up into every parent directory, up to and including the root
+	dir := filepath.Dir(diff.Path)
+	for {
+		rollup, ok := r.Directories[dir]
+		if !ok {
+			rollup = &DirectoryRollup{Files: map[DiffStatus]int{}, Bytes: map[DiffStatus]int64{}}
+			r.Directories[dir] = rollup
+		}
+		rollup.Files[diff.Status]++
+		rollup.Bytes[diff.Status] += size
+		if dir == root || dir == "." || dir == string(filepath.Separator) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
 }
 
-// CompareLocalToRemote recursively enumerates all files from `local`,
-// looking up counterparts (by name) in the parallel subtree under `remote`.
-func CompareLocalToRemote(bLog *bunnlog.BunnyLog, local, remote *PDirectory, remove bool) DiffReport {
-	var rep DiffReport
+// CompareLocalToRemote recursively diffs the files from `local` against their counterparts (by name)
+// in the parallel subtree under `remote` and the other way around, paths in the report start with `root`.
+func CompareLocalToRemote(bLog *bunnlog.BunnyLog, local, remote *PDirectory, root string) DiffReport {
+	rep := DiffReport{Directories: map[string]*DirectoryRollup{}}
 
 	var walk func(l *PDirectory, r *PDirectory, rel string)
 	walk = func(l *PDirectory, r *PDirectory, rel string) {
 		// Compare files in this directory (by base name key).
-		for name, lf := range l.Files {
-			relPath := filepath.Join(rel, name)
-			if r == nil {
-				rep.MissingInRemote = append(rep.MissingInRemote, relPath)
-				continue
+		if l != nil {
+			for name, lf := range l.Files {
+				relPath := filepath.Join(rel, name)
+				var rf *PFile
+				if r != nil {
+					rf = r.Files[name]
+				}
+				if rf == nil {
+					rep.add(root, FileDiff{Path: relPath, Status: DiffMissingInRemote, LocalSize: lf.Size.Load()})
+					continue
+				}
+
+				diff := FileDiff{Path: relPath, Status: DiffMatched, LocalSize: lf.Size.Load(), RemoteSize: rf.Size.Load(), Remote: rf}
+				if diff.LocalSize != diff.RemoteSize {
+					diff.Status = DiffSizeMismatch
+					bLog.Warnf("Size mismatch: %s (local: %d vs remote: %d)", relPath, diff.LocalSize, diff.RemoteSize)
+				} else if rf.Created != nil && lf.Created != nil && rf.Created.Load().After(lf.Created.Load()) {
+					diff.Status = DiffNewerOnRemote
+				}
+				rep.add(root, diff)
 			}
-			rf, ok := r.Files[name]
-			if !ok || rf == nil {
-				rep.MissingInRemote = append(rep.MissingInRemote, relPath)
-				continue
+		}
+		if l != nil {
+			for name, pf := range l.Partials {
+				partial := SizeMismatch{Path: filepath.Join(rel, name), LocalSize: pf.Size.Load(), RemoteSize: -1}
+				if r != nil && r.Files[name] != nil {
+					partial.Remote = r.Files[name]
+					partial.RemoteSize = partial.Remote.Size.Load()
+				}
+				rep.PartialFiles = append(rep.PartialFiles, partial)
 			}
-
-			rep.CheckedCount++
-			ls := lf.Size.Load()
-			rs := rf.Size.Load()
-			if ls == rs {
-				rep.MatchedCount++
-			} else {
-				rep.SizeMismatches = append(rep.SizeMismatches, SizeMismatch{
-					Path: relPath, LocalSize: ls, RemoteSize: rs,
-				})
-
-				msg := fmt.Sprintf("Size mismatch: %s (local: %d vs remote: %d)", relPath, ls, rs)
-				fmt.Println(msg)
-				bLog.Warn(msg)
-				if remove {
-					os.Remove(relPath)
-					bLog.Info("Removed")
+		}
+		if r != nil {
+			for name, rf := range r.Files {
+				if l == nil || l.Files[name] == nil {
+					rep.add(root, FileDiff{Path: filepath.Join(rel, name), Status: DiffMissingLocally, RemoteSize: rf.Size.Load(), Remote: rf})
 				}
 			}
 		}
 
-		// Recurse into subdirectories found locally.
-		for name, lchild := range l.Directories {
-			var rchild *PDirectory
+		// Recurse into the union of both sides' subdirectories.
+		names := map[string]bool{}
+		if l != nil {
+			for name := range l.Directories {
+				names[name] = true
+			}
+		}
+		if r != nil {
+			for name := range r.Directories {
+				names[name] = true
+			}
+		}
+		if r != nil {
+			for name := range r.Truncated {
+				rep.Truncated = append(rep.Truncated, filepath.Join(rel, name))
+				delete(names, name)
+			}
+		}
+		for name := range names {
+			var lchild, rchild *PDirectory
+			if l != nil {
+				lchild = l.Directories[name]
+			}
 			if r != nil {
 				rchild = r.Directories[name]
 			}
@@ -156,8 +287,101 @@ func CompareLocalToRemote(bLog *bunnlog.BunnyLog, local, remote *PDirectory, rem
 		}
 	}
 
-	// Start at root with empty relative path for nice paths like "dir/file".
-	walk(local, remote, remote.Name.Load())
+	// Start at root for paths that can be used as-is, like "root/dir/file".
+	walk(local, remote, root)
+	sort.Strings(rep.MissingInRemote)
+	sort.Strings(rep.MissingLocally)
+	sort.Strings(rep.NewerOnRemote)
+	sort.Strings(rep.Truncated)
+	sort.Slice(rep.SizeMismatches, func(i, j int) bool {
+		return rep.SizeMismatches[i].Path < rep.SizeMismatches[j].Path
+	})
+	sort.Slice(rep.PartialFiles, func(i, j int) bool {
+		return rep.PartialFiles[i].Path < rep.PartialFiles[j].Path
+	})
+	sort.Slice(rep.Files, func(i, j int) bool {
+		return rep.Files[i].Path < rep.Files[j].Path
+	})
 
 	return rep
 }
+
+type RepairReport struct {
+	// Partial files that were completed with a byte-range request.
+	Resumed []string
+	// Oversized or orphaned files that were removed so they can be downloaded again.
+	Deleted []string
+	// Files that were left alone, either because they are fine or because repairing them failed.
+	Untouched []string
+}
+
+// RepairMismatches resumes the PARTIAL files from the report and deletes the OVERSIZED ones,
+// unfinished downloads are resumed and renamed or cleaned up if they can't be completed,
+// files missing in remote are left untouched. Expired links are renewed with refresh, eg: RefreshLink, a nil refresh gives up on them.
+func RepairMismatches(ctx context.Context, bLog *bunnlog.BunnyLog, hClient *http.Client, refresh func(file *PFile) error, rep DiffReport) RepairReport {
+	var result RepairReport
+	result.Untouched = append(result.Untouched, rep.MissingInRemote...)
+
+	for _, mismatch := range rep.SizeMismatches {
+		repairFile(ctx, bLog, hClient, refresh, mismatch, mismatch.Path, &result)
+	}
+
+	for _, partial := range rep.PartialFiles {
+		partPath := PartPath(partial.Path)
+		if partial.Remote == nil {
+			// Orphaned, the file is gone from the cloud
+			removeForRepair(bLog, partPath, &result)
+			continue
+		}
+		if !repairFile(ctx, bLog, hClient, refresh, partial, partPath, &result) {
+			continue
+		}
+		err := os.Rename(partPath, partial.Path)
+		if err != nil {
+			bLog.Warnf("Failed to rename %s: %s", partPath, err.Error())
+		}
+	}
+
+	return result
+}
+
+// repairFile brings the file at localPath to the size of the mismatch's remote file, returns true if the file is complete afterwards
+func repairFile(ctx context.Context, bLog *bunnlog.BunnyLog, hClient *http.Client, refresh func(file *PFile) error, mismatch SizeMismatch, localPath string, result *RepairReport) bool {
+	if mismatch.LocalSize > mismatch.RemoteSize {
+		removeForRepair(bLog, localPath, result)
+		return false
+	}
+	if mismatch.LocalSize == mismatch.RemoteSize {
+		// Only happens for unfinished downloads that were interrupted right before being renamed
+		return true
+	}
+
+	written, err := ResumeFile(ctx, hClient, mismatch.Remote, localPath)
+	if errors.Is(err, ErrLinkExpired) && refresh != nil {
+		// The link is from the crawl, it may have expired since
+		err = refresh(mismatch.Remote)
+		if err == nil {
+			bLog.Infof("Refreshed the expired link of %s", localPath)
+			written, err = ResumeFile(ctx, hClient, mismatch.Remote, localPath)
+		}
+	}
+	if err != nil {
+		bLog.Warnf("Failed to resume partial file %s: %s", localPath, err.Error())
+		result.Untouched = append(result.Untouched, localPath)
+		return false
+	}
+	bLog.Infof("Resumed partial file: %s (%d bytes added)", localPath, written)
+	result.Resumed = append(result.Resumed, localPath)
+	return true
+}
+
+func removeForRepair(bLog *bunnlog.BunnyLog, localPath string, result *RepairReport) {
+	err := os.Remove(localPath)
+	if err != nil {
+		bLog.Warnf("Failed to delete %s: %s", localPath, err.Error())
+		result.Untouched = append(result.Untouched, localPath)
+		return
+	}
+	bLog.Infof("Deleted: %s", localPath)
+	result.Deleted = append(result.Deleted, localPath)
+}
@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// IgnoreFileName is the gitignore-like file in the destination that excludes paths from the sync
+const IgnoreFileName = ".pfsignore"
+
+type filterRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func (r *filterRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		// Files only match through the directory they are in
+		dir := path.Dir(relPath)
+		return dir != "." && r.re.MatchString(dir)
+	}
+	return r.re.MatchString(relPath)
+}
+
+// Filter decides which paths (relative to the synced folder, slash separated) are part of the sync.
+// A nil Filter keeps everything.
+type Filter struct {
+	include []*filterRule
+	exclude []*filterRule
+	ignore  []*filterRule // last match wins, like gitignore
+}
+
+// NewFilter parses the -include and -exclude patterns, a pattern is either a glob on the relative path,
+// "re:" followed by a regular expression or "ext:" followed by a comma separated list of extensions
+func NewFilter(include, exclude []string) (*Filter, error) {
+	f := &Filter{}
+	for _, pattern := range include {
+		rule, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", pattern, err)
+		}
+		f.include = append(f.include, rule)
+	}
+	for _, pattern := range exclude {
+		rule, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("exclude %q: %w", pattern, err)
+		}
+		f.exclude = append(f.exclude, rule)
+	}
+	return f, nil
+}
+
+// LoadIgnoreFile adds the rules of a gitignore-like file, a missing file is not an error
+func (f *Filter) LoadIgnoreFile(location string) error {
+	file, err := os.Open(location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		rule, err := parseIgnoreLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", location, lineNumber, err)
+		}
+		if rule != nil {
+			f.ignore = append(f.ignore, rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// Match returns true if the path is part of the sync, include patterns only apply to files so directories are always entered
+func (f *Filter) Match(relPath string, isDir bool) bool {
+	if f == nil {
+		return true
+	}
+	relPath = strings.TrimPrefix(relPath, "/")
+
+	ignored := false
+	for _, rule := range f.ignore {
+		if rule.match(relPath, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	if ignored {
+		return false
+	}
+	for _, rule := range f.exclude {
+		if rule.match(relPath, isDir) {
+			return false
+		}
+	}
+	if isDir || len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.match(relPath, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prune removes the files and directories the filter doesn't match from a tree, keeping its totals up to date
+func (f *Filter) Prune(dir *PDirectory) {
+	if f == nil {
+		return
+	}
+	f.prune(dir, "")
+}
+
+func (f *Filter) prune(dir *PDirectory, rel string) {
+	for name, file := range dir.Files {
+		if !f.Match(path.Join(rel, name), false) {
+			delete(dir.Files, name)
+			dir.TotalSize.Sub(file.Size.Load())
+			dir.FileCount.Dec()
+		}
+	}
+	for name := range dir.Partials {
+		if !f.Match(path.Join(rel, name), false) {
+			delete(dir.Partials, name)
+		}
+	}
+	for name, child := range dir.Directories {
+		childRel := path.Join(rel, name)
+		if !f.Match(childRel, true) {
+			delete(dir.Directories, name)
+			dir.TotalSize.Sub(child.TotalSize.Load())
+			dir.FileCount.Sub(child.FileCount.Load())
+			continue
+		}
+		beforeSize, beforeCount := child.TotalSize.Load(), child.FileCount.Load()
+		f.prune(child, childRel)
+		dir.TotalSize.Sub(beforeSize - child.TotalSize.Load())
+		dir.FileCount.Sub(beforeCount - child.FileCount.Load())
+	}
+}
+
+func parseFilterPattern(pattern string) (*filterRule, error) {
+	switch {
+	case strings.HasPrefix(pattern, "re:"):
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile: %w", err)
+		}
+		return &filterRule{re: re}, nil
+	case strings.HasPrefix(pattern, "ext:"):
+		extensions := []string{}
+		for _, ext := range strings.Split(strings.TrimPrefix(pattern, "ext:"), ",") {
+			ext = strings.TrimPrefix(strings.TrimSpace(ext), ".")
+			if len(ext) > 0 {
+				extensions = append(extensions, regexp.QuoteMeta(ext))
+			}
+		}
+		if len(extensions) == 0 {
+			return nil, errors.New("no extensions")
+		}
+		return &filterRule{re: regexp.MustCompile(`(?i)\.(` + strings.Join(extensions, "|") + `)$`)}, nil
+	default:
+		return &filterRule{re: globToRegexp(pattern, false)}, nil
+	}
+}
+
+// parseIgnoreLine parses a single gitignore-like line, blank lines and comments result in nil
+func parseIgnoreLine(line string) (*filterRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule := &filterRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+	// A slash anywhere but at the end anchors the pattern to the root
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if len(line) == 0 {
+		return nil, errors.New("empty pattern")
+	}
+	rule.re = globToRegexp(line, anchored)
+	return rule, nil
+}
+
+// globToRegexp converts a glob into a regular expression on slash separated paths,
+// "**" crosses directories and unanchored globs without a slash match the name at any depth
+func globToRegexp(glob string, anchored bool) *regexp.Regexp {
+	sb := strings.Builder{}
+	if !anchored && !strings.Contains(glob, "/") {
+		sb.WriteString(`^(?:.*/)?`)
+	} else {
+		sb.WriteString(`^`)
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					sb.WriteString(`(?:.*/)?`)
+				} else {
+					sb.WriteString(`.*`)
+				}
+			} else {
+				sb.WriteString(`[^/]*`)
+			}
+		case '?':
+			sb.WriteString(`[^/]`)
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// Matching a directory also matches everything inside of it
+	sb.WriteString(`(?:/.*)?$`)
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		// Broken character class, fall back to matching the glob literally
+		return regexp.MustCompile(`^` + regexp.QuoteMeta(glob) + `$`)
+	}
+	return re
+}
+
+// Selector limits the files we download by size and by age, a zero value disables a limit.
+// Unlike Filter it doesn't change the crawled tree, so files outside of the limits are never treated as removed from the cloud.
+type Selector struct {
+	MinSize   int64
+	MaxSize   int64
+	NewerThan time.Duration
+	OlderThan time.Duration
+}
+
+// NewSelector parses human sizes like "50MB" and ages like "36h" or "7d", empty strings disable that limit
+func NewSelector(minSize, maxSize, newerThan, olderThan string) (*Selector, error) {
+	s := &Selector{}
+	var err error
+	for _, size := range []struct {
+		in  string
+		out *int64
+	}{{minSize, &s.MinSize}, {maxSize, &s.MaxSize}} {
+		if len(size.in) == 0 {
+			continue
+		}
+		var parsed uint64
+		parsed, err = humanize.ParseBytes(size.in)
+		if err != nil {
+			return nil, fmt.Errorf("humanize.ParseBytes: %w", err)
+		}
+		*size.out = int64(parsed)
+	}
+	for _, age := range []struct {
+		in  string
+		out *time.Duration
+	}{{newerThan, &s.NewerThan}, {olderThan, &s.OlderThan}} {
+		if len(age.in) == 0 {
+			continue
+		}
+		*age.out, err = ParseAge(age.in)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Match returns true if the file is within the limits, nil matches everything
+func (s *Selector) Match(file *PFile, now time.Time) bool {
+	if s == nil {
+		return true
+	}
+	size := file.Size.Load()
+	if s.MinSize > 0 && size < s.MinSize {
+		return false
+	}
+	if s.MaxSize > 0 && size > s.MaxSize {
+		return false
+	}
+	if file.Created == nil || (s.NewerThan == 0 && s.OlderThan == 0) {
+		return true
+	}
+	age := now.Sub(file.Created.Load())
+	if s.NewerThan > 0 && age > s.NewerThan {
+		return false
+	}
+	if s.OlderThan > 0 && age < s.OlderThan {
+		return false
+	}
+	return true
+}
+
+// ParseAge is time.ParseDuration with support for days, eg: "7d" or "1d12h"
+func ParseAge(in string) (time.Duration, error) {
+	var days time.Duration
+	if idx := strings.Index(in, "d"); idx > 0 {
+		parsed, err := strconv.Atoi(in[:idx])
+		if err != nil {
+			return 0, fmt.Errorf("strconv.Atoi: %w", err)
+		}
+		days = time.Duration(parsed) * 24 * time.Hour
+		in = in[idx+1:]
+		if len(in) == 0 {
+			return days, nil
+		}
+	}
+	parsed, err := time.ParseDuration(in)
+	if err != nil {
+		return 0, fmt.Errorf("time.ParseDuration: %w", err)
+	}
+	return days + parsed, nil
+}
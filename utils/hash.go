@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// HashFile returns the hex encoded SHA-256 of a file's content
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return "", fmt.Errorf("io.Copy: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// VerifyDownload checks a freshly downloaded file against the remote size and returns its hash for the manifest.
+// The Premiumize listing doesn't expose hashes, so the size is all we can check against the remote.
+func VerifyDownload(file *PFile, localPath string) (string, error) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", fmt.Errorf("os.Stat: %w", err)
+	}
+	if info.Size() != file.Size.Load() {
+		return "", fmt.Errorf("downloaded %d bytes instead of %d", info.Size(), file.Size.Load())
+	}
+	return HashFile(localPath)
+}
+
+type VerifyReport struct {
+	// Files whose content still matches the manifest.
+	Verified []string `json:"verified"`
+	// Files whose size or hash differs from the manifest.
+	Corrupted []string `json:"corrupted"`
+	// Files in the manifest that no longer exist locally.
+	Missing []string `json:"missing"`
+	// Files that had no hash in the manifest yet, their current hash was stored.
+	Hashed []string `json:"hashed"`
+}
+
+// OK returns true if no file was corrupted or missing.
+func (r VerifyReport) OK() bool {
+	return len(r.Corrupted) == 0 && len(r.Missing) == 0
+}
+
+// Verify re-hashes every file in the state and compares it against the recorded hash
+func (s *SyncState) Verify() VerifyReport {
+	var rep VerifyReport
+
+	s.mu.Lock()
+	entries := make([]*StateEntry, 0, len(s.Entries))
+	for _, entry := range s.Entries {
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	for _, entry := range entries {
+		info, err := os.Stat(entry.Path)
+		if err != nil {
+			rep.Missing = append(rep.Missing, entry.Path)
+			continue
+		}
+		if info.Size() != entry.Size {
+			rep.Corrupted = append(rep.Corrupted, entry.Path)
+			continue
+		}
+		hash, err := HashFile(entry.Path)
+		if err != nil {
+			rep.Corrupted = append(rep.Corrupted, entry.Path)
+			continue
+		}
+		if len(entry.Hash) == 0 {
+			s.mu.Lock()
+			entry.Hash = hash
+			s.mu.Unlock()
+			rep.Hashed = append(rep.Hashed, entry.Path)
+			continue
+		}
+		if hash != entry.Hash {
+			rep.Corrupted = append(rep.Corrupted, entry.Path)
+			continue
+		}
+		rep.Verified = append(rep.Verified, entry.Path)
+	}
+
+	return rep
+}
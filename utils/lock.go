@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// bookkeepingPrefix is shared by the files we keep next to the synced files, they are never part of the local tree
+const bookkeepingPrefix = ".premiumize-file-sync."
+
+// ErrLocked is returned when another live process holds the lock
+var ErrLocked = errors.New("a sync is already in progress")
+
+// LockInfo is the content of a lockfile
+type LockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+	Version string    `json:"version"`
+	Folder  string    `json:"folder"`
+}
+
+// Lock is an exclusive lock on syncing a remote folder into a local folder, it is held through the open lockfile
+type Lock struct {
+	Location string
+	Info     LockInfo
+	file     *os.File
+}
+
+// LockFilePath returns the location of the lockfile for syncing folder into dir
+func LockFilePath(dir, folder string) string {
+	sum := sha256.Sum256([]byte(folder))
+	return filepath.Join(dir, bookkeepingPrefix+hex.EncodeToString(sum[:8])+".lock")
+}
+
+// AcquireLock takes an OS lock on the lockfile and writes our info into it. A process that dies loses its lock,
+// so a lockfile left behind by a crash is taken over without any race between the processes that want it.
+// If the lock is held it is retried every second until timeout, after which ErrLocked is returned.
+func AcquireLock(location string, info LockInfo, timeout time.Duration) (*Lock, error) {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(location), 0700)
+	if err != nil {
+		return nil, fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		lock, err := tryLock(location, data)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			lock.Info = info
+			return lock, nil
+		}
+		if !time.Now().Before(deadline) {
+			holder := readLock(location)
+			if holder == nil {
+				return nil, ErrLocked
+			}
+			return nil, fmt.Errorf("%w: PID %d on %s since %s", ErrLocked, holder.PID, holder.Host, holder.Started.Format(time.RFC3339))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// tryLock makes a single attempt, a nil lock without error means someone else holds it
+func tryLock(location string, data []byte) (*Lock, error) {
+	f, err := os.OpenFile(location, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	locked, err := tryLockFile(f)
+	if err != nil || !locked {
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("tryLockFile: %w", err)
+		}
+		return nil, nil
+	}
+	// The holder could have released and removed the file after we opened it, then our lock is on a file nobody else sees
+	opened, err := f.Stat()
+	if err != nil {
+		_ = unlockFile(f)
+		_ = f.Close()
+		return nil, fmt.Errorf("f.Stat: %w", err)
+	}
+	current, err := os.Stat(location)
+	if err != nil || !os.SameFile(opened, current) {
+		_ = unlockFile(f)
+		_ = f.Close()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("os.Stat: %w", err)
+		}
+		return nil, nil
+	}
+
+	// Whatever a dead holder left in there is replaced by our info
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(data, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		_ = unlockFile(f)
+		_ = f.Close()
+		return nil, fmt.Errorf("f.Write: %w", err)
+	}
+	return &Lock{Location: location, file: f}, nil
+}
+
+// readLock returns the holder of a lock, nil if it can't be read
+func readLock(location string) *LockInfo {
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return nil
+	}
+	holder := &LockInfo{}
+	if json.Unmarshal(data, holder) != nil {
+		return nil
+	}
+	return holder
+}
+
+// Release removes the lockfile and drops the lock
+func (l *Lock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	// Removed while we still hold it, whoever opened it in the meantime notices it is gone.
+	// Windows can't remove open files, there it is removed once closed if nobody opened it yet.
+	removeErr := os.Remove(l.Location)
+	err := unlockFile(l.file)
+	closeErr := l.file.Close()
+	l.file = nil
+	if removeErr != nil {
+		removeErr = os.Remove(l.Location)
+	}
+	if err != nil {
+		return fmt.Errorf("unlockFile: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("f.Close: %w", closeErr)
+	}
+	if removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		return fmt.Errorf("os.Remove: %w", removeErr)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build windows
+
+package utils
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset is far past the content, Windows locks are mandatory and the holder has to stay readable
+const lockOffset = 0x7fffffff
+
+// tryLockFile takes an exclusive lock on the open file without waiting, the OS drops it when the process dies
+func tryLockFile(f *os.File) (bool, error) {
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffset}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffset}
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, overlapped)
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BRUHItsABunny/bunnlog"
+)
+
+type MirrorOptions struct {
+	// Only report what would be removed.
+	DryRun bool
+	// Abort without removing anything when more files than this would be removed, 0 disables the check.
+	MaxDeletions int
+	// Move files here (keeping their relative path) instead of deleting them.
+	TrashDir string
+	// Absolute paths that are never removed, eg: our own state file.
+	Keep []string
+	// Whether the remote tree was crawled recursively, if not local subfolders are left alone.
+	Recursive bool
+}
+
+type MirrorReport struct {
+	Files       []string
+	Directories []string
+	Warnings    []string // things a dry run would abort on for real
+}
+
+// FindMissingInRemote returns the absolute paths of all local files and directories that have no counterpart in the remote tree
+func FindMissingInRemote(local, remote *PDirectory, recursive bool) (files []string, dirs []string) {
+	var walk func(l, r *PDirectory)
+	walk = func(l, r *PDirectory) {
+		for name, lf := range l.Files {
+			if r == nil || r.Files[name] == nil {
+				files = append(files, lf.Path.Load())
+			}
+		}
+		for name, pf := range l.Partials {
+			if r == nil || r.Files[name] == nil {
+				files = append(files, pf.Path.Load())
+			}
+		}
+		if !recursive {
+			return
+		}
+		for name, lchild := range l.Directories {
+			var rchild *PDirectory
+			if r != nil {
+				if _, ok := r.Truncated[name]; ok {
+					// Not crawled, we don't know what is in there
+					continue
+				}
+				rchild = r.Directories[name]
+			}
+			if rchild == nil {
+				dirs = append(dirs, lchild.Path.Load())
+			}
+			walk(lchild, rchild)
+		}
+	}
+	walk(local, remote)
+
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs
+}
+
+// MirrorLocal removes the local files and empty directories that no longer exist in the remote tree
+func MirrorLocal(bLog *bunnlog.BunnyLog, local, remote *PDirectory, opts MirrorOptions) (MirrorReport, error) {
+	var rep MirrorReport
+	root := local.Path.Load()
+	if len(opts.TrashDir) > 0 && isInside(root, opts.TrashDir) {
+		// The next mirror would see the trash as files that aren't in the cloud
+		return rep, fmt.Errorf("trash folder %s is inside the synced folder %s", opts.TrashDir, root)
+	}
+	files, dirs := FindMissingInRemote(local, remote, opts.Recursive)
+
+	keep := make(map[string]bool, len(opts.Keep))
+	for _, path := range opts.Keep {
+		keep[filepath.Clean(path)] = true
+	}
+	for _, path := range files {
+		if !keep[path] {
+			rep.Files = append(rep.Files, path)
+		}
+	}
+
+	tooMany := opts.MaxDeletions > 0 && len(rep.Files) > opts.MaxDeletions
+	if opts.DryRun {
+		// Show what would be removed anyway, that's what a dry run is for
+		if tooMany {
+			rep.Warnings = append(rep.Warnings, fmt.Sprintf("mirror would remove %d files which exceeds the maximum of %d, a real run aborts", len(rep.Files), opts.MaxDeletions))
+		}
+		rep.Directories = dirs
+		return rep, nil
+	}
+	if tooMany {
+		return rep, fmt.Errorf("mirror would remove %d files which exceeds the maximum of %d", len(rep.Files), opts.MaxDeletions)
+	}
+
+	for _, path := range rep.Files {
+		var err error
+		if len(opts.TrashDir) > 0 {
+			err = moveToTrash(root, path, opts.TrashDir)
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			return rep, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		bLog.Infof("Mirror: removed %s", path)
+	}
+
+	// Deepest first so parents are empty by the time we get to them
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	removedDirs := []string{}
+	for _, path := range dirs {
+		entries, err := os.ReadDir(path)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return rep, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		bLog.Infof("Mirror: removed directory %s", path)
+		removedDirs = append(removedDirs, path)
+	}
+	sort.Strings(removedDirs)
+	rep.Directories = removedDirs
+
+	return rep, nil
+}
+
+func moveToTrash(root, path, trashDir string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return fmt.Errorf("filepath.Rel: %w", err)
+	}
+	target := filepath.Join(trashDir, filepath.Base(root), rel)
+	err = os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+	err = os.Rename(path, target)
+	if err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+// isInside returns true if path is dir or somewhere below it
+func isInside(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/BRUHItsABunny/go-premiumize/api"
+	premiumize_client "github.com/BRUHItsABunny/go-premiumize/client"
+	"github.com/BRUHItsABunny/go-premiumize/constants"
+)
+
+type MoveReport struct {
+	Files       []string `json:"files"`       // remote paths of the deleted files
+	Directories []string `json:"directories"` // remote paths of the deleted folders
+	Errors      []string `json:"errors"`
+}
+
+// MoveRemote deletes the files with the given IDs from the cloud, followed by the folders of the tree that are empty afterwards.
+// A folder is listed again before it is deleted, so files our filters left out of the tree are never lost. The root of the tree is kept.
+func MoveRemote(ctx context.Context, pClient *premiumize_client.PremiumizeClient, root *PDirectory, verified map[string]bool, dryRun bool) *MoveReport {
+	report := &MoveReport{Files: []string{}, Directories: []string{}, Errors: []string{}}
+	gone := map[string]bool{}
+	var walk func(dir *PDirectory) bool
+	walk = func(dir *PDirectory) bool {
+		empty := len(dir.Truncated) == 0
+		for _, name := range sortedNames(dir.Files) {
+			file := dir.Files[name]
+			if !verified[file.ID.Load()] {
+				empty = false
+				continue
+			}
+			if !dryRun {
+				err := DeleteItem(ctx, pClient, file.ID.Load())
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", file.GetFullPath(), err.Error()))
+					empty = false
+					continue
+				}
+			}
+			gone[file.ID.Load()] = true
+			report.Files = append(report.Files, file.GetFullPath())
+		}
+		for _, name := range sortedNames(dir.Directories) {
+			child := dir.Directories[name]
+			if !walk(child) {
+				empty = false
+				continue
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+			// Our tree may be filtered or outdated, only the cloud knows if the folder is really empty
+			remaining, err := remainingItems(ctx, pClient, child.ID.Load(), gone)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", child.Path.Load(), err.Error()))
+				empty = false
+				continue
+			}
+			if remaining > 0 {
+				empty = false
+				continue
+			}
+			if !dryRun {
+				err = DeleteFolder(ctx, pClient, child.ID.Load())
+				if err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", child.Path.Load(), err.Error()))
+					empty = false
+					continue
+				}
+			}
+			gone[child.ID.Load()] = true
+			report.Directories = append(report.Directories, child.Path.Load())
+		}
+		return empty
+	}
+	walk(root)
+	return report
+}
+
+// remainingItems counts the items of a remote folder that are not about to be deleted
+func remainingItems(ctx context.Context, pClient *premiumize_client.PremiumizeClient, folderID string, gone map[string]bool) (int, error) {
+	listResp, err := pClient.FoldersList(ctx, &api.FolderListRequest{ID: folderID})
+	if err != nil {
+		return 0, fmt.Errorf("pClient.FoldersList: %w", err)
+	}
+	if listResp.Status != "success" {
+		return 0, apiError(&listResp.PremiumizeAPIResponse)
+	}
+	remaining := 0
+	for _, item := range listResp.Content {
+		if !gone[item.ID] {
+			remaining++
+		}
+	}
+	return remaining, nil
+}
+
+// DeleteItem deletes a file from the cloud
+func DeleteItem(ctx context.Context, pClient *premiumize_client.PremiumizeClient, id string) error {
+	return premiumizePost(ctx, pClient, constants.EndpointItemDelete, url.Values{"id": {id}})
+}
+
+// DeleteFolder deletes a folder and everything in it from the cloud
+func DeleteFolder(ctx context.Context, pClient *premiumize_client.PremiumizeClient, id string) error {
+	return premiumizePost(ctx, pClient, constants.EndpointFolderDelete, url.Values{"id": {id}})
+}
+
+// premiumizePost calls an endpoint the go-premiumize client doesn't implement, authenticating the same way it does
+func premiumizePost(ctx context.Context, pClient *premiumize_client.PremiumizeClient, endpoint string, params url.Values) error {
+	session := pClient.Session
+	if session != nil && session.SessionType == "apikey" && len(session.AuthToken) > 0 {
+		params.Set("apikey", session.AuthToken)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", constants.HeaderContentTypeForm)
+	req.Header.Set("User-Agent", constants.HeaderUserAgent)
+	if session != nil && session.SessionType == constants.TokenResponseType && len(session.AuthToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+session.AuthToken)
+	}
+	resp, err := pClient.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pClient.Client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("io.ReadAll: %w", err)
+	}
+	result := &api.PremiumizeAPIResponse{}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("json.Unmarshal (status code %d): %w", resp.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return apiError(result)
+	}
+	return nil
+}
+
+func apiError(resp *api.PremiumizeAPIResponse) error {
+	if resp.Message != nil {
+		return errors.New(*resp.Message)
+	}
+	return fmt.Errorf("status %q", resp.Status)
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,9 +2,11 @@ package utils
 
 import (
 	"context"
+	"fmt"
 	"github.com/BRUHItsABunny/go-premiumize/api"
 	premiumize_client "github.com/BRUHItsABunny/go-premiumize/client"
 	"go.uber.org/atomic"
+	"path"
 	"strings"
 	"time"
 )
@@ -16,23 +18,54 @@ type PDirectory struct {
 	Name        *atomic.String
 	Directories map[string]*PDirectory // use thread unsafe maps, we fill it once and the keys nor the pointers should ever change after that
 	Files       map[string]*PFile      // could switch to github.com/cornelk/hashmap if really needed, low write perf. should not be a deal-breaker for our use case since we write once then read only
+	Partials    map[string]*PFile      // local only, unfinished downloads keyed by the name they will get once complete
+	Truncated   map[string]string      // remote only, subfolders that were not crawled because of the depth limit, name to folder ID
 	TotalSize   *atomic.Int64
 	FileCount   *atomic.Int64
 }
 
 type PFile struct {
-	ID      *atomic.String
-	Path    *atomic.String
-	Name    *atomic.String
-	Size    *atomic.Int64
-	Link    *atomic.String
-	Created *atomic.Time
+	ID       *atomic.String
+	ParentID *atomic.String
+	Path     *atomic.String
+	Name     *atomic.String
+	Size     *atomic.Int64
+	Link     *atomic.String
+	Created  *atomic.Time
 }
 
 func (f *PFile) GetFullPath() string {
 	return f.Path.Load() + "/" + f.Name.Load()
 }
 
+// WalkFiles calls fn for every file in the directory and its subdirectories
+func WalkFiles(directory *PDirectory, fn func(file *PFile)) {
+	for _, file := range directory.Files {
+		fn(file)
+	}
+	for _, subDirectory := range directory.Directories {
+		WalkFiles(subDirectory, fn)
+	}
+}
+
+// ChangedFiles returns the files of current that are new or got replaced since the previous snapshot, keyed by their full remote path
+func ChangedFiles(previous, current *PDirectory) map[string]*PFile {
+	known := map[string]*PFile{}
+	if previous != nil {
+		WalkFiles(previous, func(file *PFile) {
+			known[file.GetFullPath()] = file
+		})
+	}
+	result := map[string]*PFile{}
+	WalkFiles(current, func(file *PFile) {
+		old, ok := known[file.GetFullPath()]
+		if !ok || old.ID.Load() != file.ID.Load() || old.Size.Load() != file.Size.Load() {
+			result[file.GetFullPath()] = file
+		}
+	})
+	return result
+}
+
 // RefreshLinks Refreshes links inside a directory recursively
 func RefreshLinks(pClient *premiumize_client.PremiumizeClient, directory *PDirectory, recursive bool) error {
 	listResp, err := pClient.FoldersList(context.Background(), &api.FolderListRequest{ID: directory.ID.Load()})
@@ -40,25 +73,61 @@ func RefreshLinks(pClient *premiumize_client.PremiumizeClient, directory *PDirec
 		return err
 	}
 
+	// Our maps are keyed by name, not by ID
 	for _, item := range listResp.Content {
-		if item.Type == "folder" && recursive {
-			err = RefreshLinks(pClient, directory.Directories[item.ID], recursive)
-			if err != nil {
-				return err
+		if item.Type == "folder" {
+			subDirectory, ok := directory.Directories[item.Name]
+			if ok && recursive {
+				err = RefreshLinks(pClient, subDirectory, recursive)
+				if err != nil {
+					return err
+				}
 			}
 		} else {
-			directory.Files[item.ID].Link.Store(*item.Link)
+			file, ok := directory.Files[item.Name]
+			if ok && item.Link != nil {
+				file.Link.Store(*item.Link)
+			}
 		}
 	}
 
 	return nil
 }
 
+// RefreshLink Refreshes the link of a single file by listing its parent folder
+func RefreshLink(pClient *premiumize_client.PremiumizeClient, file *PFile) error {
+	listResp, err := pClient.FoldersList(context.Background(), &api.FolderListRequest{ID: file.ParentID.Load()})
+	if err != nil {
+		return err
+	}
+
+	for _, item := range listResp.Content {
+		if item.ID == file.ID.Load() && item.Link != nil {
+			file.Link.Store(*item.Link)
+			return nil
+		}
+	}
+	return fmt.Errorf("file %s no longer exists in folder %s", file.ID.Load(), file.ParentID.Load())
+}
+
+type CrawlOptions struct {
+	Recursive bool
+	// How many levels of folders to crawl when Recursive, 1 is only the folder itself and 0 is unlimited.
+	Depth int
+	// Paths the filter doesn't match are left out of the tree and its totals, nil keeps everything.
+	Filter *Filter
+}
+
 // CrawlFilesystem crawls the directory we are syncing on the cloud's filesystem, collecting links and statistics while doing so, recursively?
-func CrawlFilesystem(pClient *premiumize_client.PremiumizeClient, pathPrefix, directoryId string, recursive bool) *PDirectory {
+func CrawlFilesystem(pClient *premiumize_client.PremiumizeClient, pathPrefix, directoryId string, opts CrawlOptions) (*PDirectory, error) {
+	return crawl(pClient, pathPrefix, "", directoryId, 1, opts)
+}
+
+// crawl does the work for CrawlFilesystem, rel is the path relative to the synced folder that the filter is matched against and level is its depth starting at 1
+func crawl(pClient *premiumize_client.PremiumizeClient, pathPrefix, rel, directoryId string, level int, opts CrawlOptions) (*PDirectory, error) {
 	listResp, err := pClient.FoldersList(context.Background(), &api.FolderListRequest{ID: directoryId})
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("pClient.FoldersList: %w", err)
 	}
 	result := &PDirectory{
 		ID:          atomic.NewString(listResp.FolderID),
@@ -66,6 +135,7 @@ func CrawlFilesystem(pClient *premiumize_client.PremiumizeClient, pathPrefix, di
 		Name:        atomic.NewString(listResp.Name),
 		Directories: map[string]*PDirectory{},
 		Files:       map[string]*PFile{},
+		Truncated:   map[string]string{},
 		TotalSize:   atomic.NewInt64(0),
 		FileCount:   atomic.NewInt64(0),
 	}
@@ -76,29 +146,44 @@ func CrawlFilesystem(pClient *premiumize_client.PremiumizeClient, pathPrefix, di
 	pathPrefix += listResp.Name
 	result.Path = atomic.NewString(pathPrefix)
 	for _, item := range listResp.Content {
-		if item.Type == "folder" && recursive {
-			result.Directories[item.Name] = CrawlFilesystem(pClient, pathPrefix, item.ID, recursive)
+		itemRel := path.Join(rel, item.Name)
+		if !opts.Filter.Match(itemRel, item.Type == "folder") {
+			continue
+		}
+		if item.Type == "folder" {
+			if !opts.Recursive {
+				continue
+			}
+			if opts.Depth > 0 && level >= opts.Depth {
+				result.Truncated[item.Name] = item.ID
+				continue
+			}
+			result.Directories[item.Name], err = crawl(pClient, pathPrefix, itemRel, item.ID, level+1, opts)
+			if err != nil {
+				return nil, err
+			}
 			result.TotalSize.Add(result.Directories[item.Name].TotalSize.Load())
 			result.FileCount.Add(result.Directories[item.Name].FileCount.Load())
 		} else {
 			result.Files[item.Name] = &PFile{
-				ID:      atomic.NewString(item.ID),
-				Path:    atomic.NewString(result.Path.Load()),
-				Name:    atomic.NewString(item.Name),
-				Size:    atomic.NewInt64(int64(*item.Size)),
-				Link:    atomic.NewString(*item.Link),
-				Created: atomic.NewTime(time.Unix(int64(*item.CreatedAt), 0)),
+				ID:       atomic.NewString(item.ID),
+				ParentID: atomic.NewString(listResp.FolderID),
+				Path:     atomic.NewString(result.Path.Load()),
+				Name:     atomic.NewString(item.Name),
+				Size:     atomic.NewInt64(int64(*item.Size)),
+				Link:     atomic.NewString(*item.Link),
+				Created:  atomic.NewTime(time.Unix(int64(*item.CreatedAt), 0)),
 			}
 			result.FileCount.Inc()
 			result.TotalSize.Add(result.Files[item.Name].Size.Load())
 		}
 	}
 
-	return result
+	return result, nil
 }
 
 // LocateDirectory locates the directory on the cloud we want to sync to our local filesystem
-func LocateDirectory(pClient *premiumize_client.PremiumizeClient, path string, recursive bool) *PDirectory {
+func LocateDirectory(pClient *premiumize_client.PremiumizeClient, path string, opts CrawlOptions) (*PDirectory, error) {
 	// Find the folder, check against name and id?
 	offset := 0
 	if strings.HasPrefix(path, "My Files/") || strings.HasPrefix(path, "/") {
@@ -122,10 +207,9 @@ func LocateDirectory(pClient *premiumize_client.PremiumizeClient, path string, r
 				}
 			}
 		} else {
-			panic(err)
+			return nil, fmt.Errorf("pClient.FoldersList: %w", err)
 		}
 	}
 
-	folder := CrawlFilesystem(pClient, "", folderID, recursive)
-	return folder
+	return CrawlFilesystem(pClient, "", folderID, opts)
 }
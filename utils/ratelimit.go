@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"go.uber.org/atomic"
+)
+
+// pausePollInterval is how often paused downloads check if they may continue
+const pausePollInterval = 250 * time.Millisecond
+
+// rateLimitChunk caps a single read so a slow limit doesn't stall for long after a big read
+const rateLimitChunk = 32 * 1024
+
+// RateLimiter is a token bucket in bytes per second shared by all downloads, a limit of 0 disables it.
+// The limit can be changed at any time and applies to the running downloads right away, pausing stops them from reading.
+type RateLimiter struct {
+	mu     sync.Mutex
+	paused bool
+	limit  int64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit int64) *RateLimiter {
+	return &RateLimiter{limit: limit, last: time.Now()}
+}
+
+// Limit returns the current limit in bytes per second
+func (r *RateLimiter) Limit() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.limit
+}
+
+// SetLimit changes the limit in bytes per second, 0 disables it
+func (r *RateLimiter) SetLimit(limit int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+	if r.tokens > float64(limit) {
+		r.tokens = float64(limit)
+	}
+}
+
+// SetPaused pauses or resumes all downloads
+func (r *RateLimiter) SetPaused(paused bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = paused
+}
+
+// WaitN takes n bytes from the bucket and sleeps until the bucket isn't in debt anymore and we are not paused
+func (r *RateLimiter) WaitN(ctx context.Context, n int) error {
+	r.mu.Lock()
+	for r.paused {
+		r.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pausePollInterval):
+		}
+		r.mu.Lock()
+	}
+	now := time.Now()
+	if r.limit <= 0 {
+		r.last = now
+		r.mu.Unlock()
+		return nil
+	}
+	limit := float64(r.limit)
+	r.tokens += now.Sub(r.last).Seconds() * limit
+	if r.tokens > limit {
+		// At most a second worth of burst
+		r.tokens = limit
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	wait := time.Duration(0)
+	if r.tokens < 0 {
+		wait = time.Duration(-r.tokens / limit * float64(time.Second))
+	}
+	r.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// RateLimitTransport slows down reading the response bodies to the limiter's rate
+type RateLimitTransport struct {
+	Base    http.RoundTripper
+	Limiter *RateLimiter
+	// Counts every byte read from the bodies, nil disables counting
+	Bytes *atomic.Uint64
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	resp.Body = &rateLimitedBody{ReadCloser: resp.Body, limiter: t.Limiter, bytes: t.Bytes, ctx: req.Context()}
+	return resp, nil
+}
+
+type rateLimitedBody struct {
+	io.ReadCloser
+	limiter *RateLimiter
+	bytes   *atomic.Uint64
+	ctx     context.Context
+}
+
+func (b *rateLimitedBody) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if b.bytes != nil {
+			b.bytes.Add(uint64(n))
+		}
+		waitErr := b.limiter.WaitN(b.ctx, n)
+		if waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// ParseRate parses a rate like "20MB/s" or "500KiB" into bytes per second, empty and "0" mean unlimited
+func ParseRate(in string) (int64, error) {
+	in = strings.TrimSuffix(strings.TrimSpace(in), "/s")
+	if len(in) == 0 || in == "0" {
+		return 0, nil
+	}
+	rate, err := humanize.ParseBytes(in)
+	if err != nil {
+		return 0, fmt.Errorf("humanize.ParseBytes: %w", err)
+	}
+	return int64(rate), nil
+}
+
+// RateWindow is a time of day range with its own limit, End before Start wraps around midnight
+type RateWindow struct {
+	Start time.Duration // since midnight
+	End   time.Duration
+	Limit int64
+}
+
+// RateSchedule picks the limit by the time of day, outside of the windows the default limit applies
+type RateSchedule struct {
+	Default int64
+	Windows []RateWindow
+}
+
+// ParseRateSchedule parses a comma separated list of windows like "09:00-18:00=5MB/s,18:00-23:00=20MB/s"
+func ParseRateSchedule(defaultRate, schedule string) (*RateSchedule, error) {
+	result := &RateSchedule{}
+	var err error
+	result.Default, err = ParseRate(defaultRate)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(schedule, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		span, rate, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing rate in %q", part)
+		}
+		start, end, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("missing end time in %q", part)
+		}
+		window := RateWindow{}
+		window.Start, err = parseTimeOfDay(start)
+		if err != nil {
+			return nil, err
+		}
+		window.End, err = parseTimeOfDay(end)
+		if err != nil {
+			return nil, err
+		}
+		window.Limit, err = ParseRate(rate)
+		if err != nil {
+			return nil, err
+		}
+		result.Windows = append(result.Windows, window)
+	}
+	return result, nil
+}
+
+// LimitAt returns the limit of the first window that contains the time of day of t
+func (s *RateSchedule) LimitAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	for _, window := range s.Windows {
+		if window.Start <= window.End {
+			if now >= window.Start && now < window.End {
+				return window.Limit
+			}
+		} else if now >= window.Start || now < window.End {
+			return window.Limit
+		}
+	}
+	return s.Default
+}
+
+func parseTimeOfDay(in string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(in))
+	if err != nil {
+		return 0, fmt.Errorf("time.Parse: %w", err)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	ReportFormatTable = "table"
+	ReportFormatJSON  = "json"
+	ReportFormatCSV   = "csv"
+)
+
+// WriteReport writes the report in one of the ReportFormat* formats
+func WriteReport(w io.Writer, rep DiffReport, format string) error {
+	switch format {
+	case ReportFormatJSON:
+		return writeReportJSON(w, rep)
+	case ReportFormatCSV:
+		return writeReportCSV(w, rep)
+	case ReportFormatTable, "":
+		return writeReportTable(w, rep)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+}
+
+// reportRows flattens the report into status, path, local size and remote size rows, sizes that don't apply or aren't known are empty
+func reportRows(rep DiffReport) [][]string {
+	diffs := make(map[string]FileDiff, len(rep.Files))
+	for _, diff := range rep.Files {
+		diffs[diff.Path] = diff
+	}
+	localSize := func(path string) string {
+		if diff, ok := diffs[path]; ok {
+			return formatSize(diff.LocalSize)
+		}
+		return ""
+	}
+	remoteSize := func(path string) string {
+		if diff, ok := diffs[path]; ok {
+			return formatSize(diff.RemoteSize)
+		}
+		return ""
+	}
+
+	rows := [][]string{}
+	for _, path := range rep.MissingLocally {
+		rows = append(rows, []string{"missing_locally", path, "", remoteSize(path)})
+	}
+	for _, path := range rep.MissingInRemote {
+		rows = append(rows, []string{"missing_in_remote", path, localSize(path), ""})
+	}
+	for _, mismatch := range rep.SizeMismatches {
+		rows = append(rows, []string{"size_mismatch", mismatch.Path, formatSize(mismatch.LocalSize), formatSize(mismatch.RemoteSize)})
+	}
+	for _, path := range rep.NewerOnRemote {
+		rows = append(rows, []string{"newer_on_remote", path, localSize(path), remoteSize(path)})
+	}
+	for _, partial := range rep.PartialFiles {
+		rows = append(rows, []string{"partial", partial.Path, formatSize(partial.LocalSize), formatSize(partial.RemoteSize)})
+	}
+	for _, path := range rep.Truncated {
+		rows = append(rows, []string{"truncated", path, "", ""})
+	}
+	return rows
+}
+
+// formatSize leaves negative sizes, which mean unknown, empty
+func formatSize(size int64) string {
+	if size < 0 {
+		return ""
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+func writeReportJSON(w io.Writer, rep DiffReport) error {
+	type jsonReport struct {
+		DiffReport
+		OK bool `json:"ok"`
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(jsonReport{DiffReport: rep, OK: rep.OK()})
+	if err != nil {
+		return fmt.Errorf("encoder.Encode: %w", err)
+	}
+	return nil
+}
+
+func writeReportCSV(w io.Writer, rep DiffReport) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"status", "path", "local_size", "remote_size"})
+	if err != nil {
+		return fmt.Errorf("writer.Write: %w", err)
+	}
+	err = writer.WriteAll(reportRows(rep))
+	if err != nil {
+		return fmt.Errorf("writer.WriteAll: %w", err)
+	}
+	return nil
+}
+
+func writeReportTable(w io.Writer, rep DiffReport) error {
+	writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "STATUS\tPATH\tLOCAL SIZE\tREMOTE SIZE")
+	for _, row := range reportRows(rep) {
+		for i := 2; i < len(row); i++ {
+			if len(row[i]) == 0 {
+				row[i] = "-"
+			}
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", row[0], row[1], row[2], row[3])
+	}
+	fmt.Fprintf(writer, "\nChecked: %d, matched: %d, missing locally: %d, missing in remote: %d, size mismatches: %d, newer on remote: %d, truncated by depth: %d\n", rep.CheckedCount, rep.MatchedCount, len(rep.MissingLocally), len(rep.MissingInRemote), len(rep.SizeMismatches), len(rep.NewerOnRemote), len(rep.Truncated))
+
+	dirs := make([]string, 0, len(rep.Directories))
+	for dir := range rep.Directories {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	fmt.Fprintln(writer, "\nDIRECTORY\tMATCHED\tMISSING LOCALLY\tMISSING IN REMOTE\tSIZE MISMATCH\tNEWER ON REMOTE")
+	for _, dir := range dirs {
+		rollup := rep.Directories[dir]
+		fmt.Fprintf(writer, "%s", dir)
+		for _, status := range []DiffStatus{DiffMatched, DiffMissingLocally, DiffMissingInRemote, DiffSizeMismatch, DiffNewerOnRemote} {
+			fmt.Fprintf(writer, "\t%d (%s)", rollup.Files[status], humanize.Bytes(uint64(rollup.Bytes[status])))
+		}
+		fmt.Fprintln(writer)
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultStateName = ".premiumize-file-sync.state.json"
+
+type StateEntry struct {
+	ID         string    `json:"id"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Created    time.Time `json:"created"`
+	ModTime    time.Time `json:"modTime"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	Hash       string    `json:"hash,omitempty"`       // SHA-256 of the content, empty if it was never hashed
+	Downloaded bool      `json:"downloaded,omitempty"` // set when we downloaded the file and it passed verification, not when -verify hashed an existing copy
+}
+
+// SyncState remembers which remote files have been downloaded completely, so incremental runs can skip them
+type SyncState struct {
+	mu       sync.Mutex
+	Location string                 `json:"-"`
+	Entries  map[string]*StateEntry `json:"entries"` // keyed by local path
+}
+
+// LoadState reads the state file at location, a missing file results in an empty state
+func LoadState(location string) (*SyncState, error) {
+	state := &SyncState{Location: location, Entries: map[string]*StateEntry{}}
+	data, err := os.ReadFile(location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*StateEntry{}
+	}
+	return state, nil
+}
+
+// Save writes the state to a temporary file first and renames it over the old one, so a crash never leaves half a state file
+func (s *SyncState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save()
+}
+
+func (s *SyncState) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if dir := filepath.Dir(s.Location); dir != "" {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return fmt.Errorf("os.MkdirAll: %w", err)
+		}
+	}
+	tmp := s.Location + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("os.WriteFile: %w", err)
+	}
+	err = os.Rename(tmp, s.Location)
+	if err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+// Record stores the remote file as synced to localPath and persists the state
+func (s *SyncState) Record(file *PFile, localPath, hash string) error {
+	err := s.Add(file, localPath, hash)
+	if err != nil {
+		return err
+	}
+	return s.Save()
+}
+
+// RecordDownload stores the remote file as downloaded and verified by us to localPath and persists the state
+func (s *SyncState) RecordDownload(file *PFile, localPath, hash string) error {
+	err := s.Add(file, localPath, hash)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.Entries[localPath].Downloaded = true
+	s.mu.Unlock()
+	return s.Save()
+}
+
+// Add stores the remote file as synced to localPath without persisting the state
+func (s *SyncState) Add(file *PFile, localPath, hash string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+
+	entry := newStateEntry(file, localPath, info)
+	entry.Hash = hash
+	s.mu.Lock()
+	s.Entries[localPath] = entry
+	s.mu.Unlock()
+	return nil
+}
+
+// Forget removes localPath from the state without persisting it
+func (s *SyncState) Forget(localPath string) {
+	s.mu.Lock()
+	delete(s.Entries, localPath)
+	s.mu.Unlock()
+}
+
+// Changed returns true if localPath was synced from a different remote file than the current one, eg: it got replaced on the cloud
+func (s *SyncState) Changed(file *PFile, localPath string) bool {
+	s.mu.Lock()
+	entry, ok := s.Entries[localPath]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if entry.ID != file.ID.Load() || entry.Size != file.Size.Load() {
+		return true
+	}
+	return file.Created != nil && !entry.Created.Equal(file.Created.Load())
+}
+
+// IsSynced returns true if the remote file was downloaded before and the local copy was not touched since
+func (s *SyncState) IsSynced(file *PFile, localPath string) bool {
+	s.mu.Lock()
+	entry, ok := s.Entries[localPath]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if s.Changed(file, localPath) {
+		return false
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return false
+	}
+	return info.Size() == entry.Size && info.ModTime().Equal(entry.ModTime)
+}
+
+// IsDownloaded returns true if IsSynced and the local copy was recorded with RecordDownload, eg: by a previous run
+func (s *SyncState) IsDownloaded(file *PFile, localPath string) bool {
+	if !s.IsSynced(file, localPath) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Entries[localPath].Downloaded
+}
+
+// Rebuild replaces all entries with the files from the local tree whose size matches their remote counterpart, returns how many were recorded
+func (s *SyncState) Rebuild(local, remote *PDirectory, dest Destination) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Entries = map[string]*StateEntry{}
+
+	var walk func(l, r *PDirectory)
+	walk = func(l, r *PDirectory) {
+		for name, rf := range r.Files {
+			lf, ok := l.Files[name]
+			if !ok || lf.Size.Load() != rf.Size.Load() {
+				continue
+			}
+			info, err := os.Stat(lf.Path.Load())
+			if err != nil {
+				continue
+			}
+			localPath := dest.Path(rf)
+			s.Entries[localPath] = newStateEntry(rf, localPath, info)
+		}
+		for name, rchild := range r.Directories {
+			lchild, ok := l.Directories[name]
+			if ok {
+				walk(lchild, rchild)
+			}
+		}
+	}
+	walk(local, remote)
+	return len(s.Entries)
+}
+
+func newStateEntry(file *PFile, localPath string, info os.FileInfo) *StateEntry {
+	entry := &StateEntry{
+		ID:        file.ID.Load(),
+		Path:      localPath,
+		Size:      info.Size(),
+		ModTime:   info.ModTime(),
+		UpdatedAt: time.Now(),
+	}
+	if file.Created != nil {
+		entry.Created = file.Created.Load()
+	}
+	return entry
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrLinkExpired is returned for download links that Premiumize no longer serves, the link has to be refreshed
+var ErrLinkExpired = errors.New("download link expired")
+
+// LinkCheckTransport turns the responses of expired download links into ErrLinkExpired,
+// without it the error page would be written to disk as if it were the file.
+type LinkCheckTransport struct {
+	Base http.RoundTripper
+}
+
+func (t *LinkCheckTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: status code %d", ErrLinkExpired, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// ObserveTransport reports the duration and outcome of every request, eg: for metrics
+type ObserveTransport struct {
+	Base    http.RoundTripper
+	Observe func(req *http.Request, duration time.Duration, err error)
+}
+
+func (t *ObserveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.Base.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 400 {
+		t.Observe(req, time.Since(start), fmt.Errorf("status code %d", resp.StatusCode))
+	} else {
+		t.Observe(req, time.Since(start), err)
+	}
+	return resp, err
+}
@@ -1,20 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/app"
 	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+	"github.com/BRUHItsABunny/bunnlog"
+	gokhttp_download "github.com/BRUHItsABunny/gOkHttp-download"
 	premiumize "github.com/BRUHItsABunny/go-premiumize"
+	"github.com/BRUHItsABunny/go-premiumize/api"
 	"github.com/BRUHItsABunny/go-premiumize/client"
 	"github.com/cornelk/hashmap"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/dustin/go-humanize"
 	"github.com/joho/godotenv"
 	"go.uber.org/atomic"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -38,10 +52,42 @@ func defaultClient() *client.PremiumizeClient {
 	return premiumize.GetPremiumizeClient(premiumize.GetPremiumizeAPISession(os.Getenv("PREMIUMIZE_API_KEY")), hClient)
 }
 
+// newTestDir returns an empty folder of a tree, its name is the last element of its slash separated path
+func newTestDir(id, dirPath string) *utils.PDirectory {
+	return &utils.PDirectory{
+		ID:          atomic.NewString(id),
+		Name:        atomic.NewString(path.Base(dirPath)),
+		Path:        atomic.NewString(dirPath),
+		Directories: map[string]*utils.PDirectory{},
+		Files:       map[string]*utils.PFile{},
+		Truncated:   map[string]string{},
+		TotalSize:   atomic.NewInt64(0),
+		FileCount:   atomic.NewInt64(0),
+	}
+}
+
+// addTestFile adds a file to a folder of a tree, its link is empty
+func addTestFile(dir *utils.PDirectory, id, name string, size int64, created time.Time) *utils.PFile {
+	file := &utils.PFile{
+		ID:       atomic.NewString(id),
+		ParentID: atomic.NewString(dir.ID.Load()),
+		Path:     atomic.NewString(dir.Path.Load()),
+		Name:     atomic.NewString(name),
+		Size:     atomic.NewInt64(size),
+		Link:     atomic.NewString(""),
+		Created:  atomic.NewTime(created),
+	}
+	dir.Files[name] = file
+	return file
+}
+
 func TestPremiumize(t *testing.T) {
 	_ = utils.LoadEnv()
 	pClient := defaultClient()
-	directory := utils.LocateDirectory(pClient, os.Getenv("PREMIUMIZE_TARGET_FOLDER"), true)
+	directory, err := utils.LocateDirectory(pClient, os.Getenv("PREMIUMIZE_TARGET_FOLDER"), utils.CrawlOptions{Recursive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
 	fmt.Println(spew.Sdump(directory))
 	fmt.Println("Total size: " + humanize.Bytes(uint64(directory.TotalSize.Load())))
 }
@@ -206,3 +252,1675 @@ func TestChannelLogicWorker(t *testing.T) {
 
 	fmt.Println("Done")
 }
+
+func TestSyncState(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "bunny.bun")
+	err := os.WriteFile(localPath, []byte("bunbunbun"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := &utils.PFile{
+		ID:      atomic.NewString("bunnyID"),
+		Path:    atomic.NewString(dir),
+		Name:    atomic.NewString("bunny.bun"),
+		Size:    atomic.NewInt64(9),
+		Created: atomic.NewTime(time.Unix(1700000000, 0)),
+	}
+
+	state, err := utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.IsSynced(file, localPath) {
+		t.Error("empty state reports file as synced")
+	}
+	err = state.Record(file, localPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.IsSynced(file, localPath) {
+		t.Error("recorded file is not synced after reload")
+	}
+
+	file.Size.Store(10)
+	if state.IsSynced(file, localPath) {
+		t.Error("changed remote file reports as synced")
+	}
+}
+
+func TestMirrorDryRun(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "bunny")
+	for _, name := range []string{"keep.bun", "gone.bun", "old/gone.bun"} {
+		err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(root, name), []byte("bun"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local, err := utils.BuildDirectoryTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := newTestDir("root", "bunny")
+	addTestFile(remote, "keep", "keep.bun", 3, time.Now())
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	report, err := utils.MirrorLocal(&bLog, local, remote, utils.MirrorOptions{DryRun: true, Recursive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 2 || len(report.Directories) != 1 {
+		t.Errorf("unexpected report: %s", spew.Sdump(report))
+	}
+	_, err = os.Stat(filepath.Join(root, "gone.bun"))
+	if err != nil {
+		t.Error("dry run removed a file")
+	}
+
+	report, err = utils.MirrorLocal(&bLog, local, remote, utils.MirrorOptions{DryRun: true, MaxDeletions: 1, Recursive: true})
+	if err != nil || len(report.Files) != 2 || len(report.Warnings) != 1 {
+		t.Errorf("dry run over max deletions doesn't report with a warning: %v %s", err, spew.Sdump(report))
+	}
+	_, err = utils.MirrorLocal(&bLog, local, remote, utils.MirrorOptions{MaxDeletions: 1, Recursive: true})
+	if err == nil {
+		t.Error("max deletions was not enforced")
+	}
+	_, err = utils.MirrorLocal(&bLog, local, remote, utils.MirrorOptions{TrashDir: filepath.Join(root, "old", ".trash"), Recursive: true})
+	if err == nil {
+		t.Error("trash folder inside the synced folder is accepted")
+	}
+	_, err = os.Stat(filepath.Join(root, "gone.bun"))
+	if err != nil {
+		t.Error("rejected mirror removed a file")
+	}
+}
+
+// TestMirrorKeep mirrors into the working directory like -strip-root -dest . does, our own files live there too
+func TestMirrorKeep(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	job, err := app.NewSyncJob("bunny", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Directory = newTestDir("root", "bunny")
+	job.Dest = utils.NewDestination(".", true, "bunny")
+	job.State, err = utils.LoadState(filepath.Join(".", utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := []string{"run.log", ".env", "health.json", "health.json.tmp"}
+	for _, name := range append([]string{"gone.bun"}, own...) {
+		err = os.WriteFile(filepath.Join(dir, name), []byte("bun"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{Cfg: &app.Config{Mirror: true, Recursive: true, HealthPath: "health.json", Daemon: true}, BLog: &bLog, LogPath: "run.log"}
+	mirror(appData, job)
+	_, err = os.Stat(filepath.Join(dir, "gone.bun"))
+	if !os.IsNotExist(err) {
+		t.Error("mirror didn't remove a file that is gone from the cloud")
+	}
+	for _, name := range own {
+		_, err = os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("mirror removed %s", name)
+		}
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	rep := utils.DiffReport{
+		MissingLocally: []string{"bunny/new.bun"},
+		SizeMismatches: []utils.SizeMismatch{{Path: "bunny/partial.bun", LocalSize: 1, RemoteSize: 3}},
+		PartialFiles:   []utils.SizeMismatch{{Path: "bunny/gone.bun", LocalSize: 2, RemoteSize: -1}},
+		Files: []utils.FileDiff{
+			{Path: "bunny/new.bun", Status: utils.DiffMissingLocally, RemoteSize: 7},
+			{Path: "bunny/partial.bun", Status: utils.DiffSizeMismatch, LocalSize: 1, RemoteSize: 3},
+		},
+		CheckedCount: 1,
+	}
+
+	buf := &bytes.Buffer{}
+	err := utils.WriteReport(buf, rep, utils.ReportFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "status,path,local_size,remote_size\nmissing_locally,bunny/new.bun,,7\nsize_mismatch,bunny/partial.bun,1,3\npartial,bunny/gone.bun,2,\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected CSV:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	err = utils.WriteReport(buf, rep, utils.ReportFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := map[string]any{}
+	err = json.Unmarshal(buf.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded["ok"] != false {
+		t.Error("report with size mismatches is marked as ok")
+	}
+}
+
+func TestDiffReportOK(t *testing.T) {
+	for name, rep := range map[string]utils.DiffReport{
+		"missing locally":   {MissingLocally: []string{"bunny/a.bun"}},
+		"missing in remote": {MissingInRemote: []string{"bunny/a.bun"}},
+		"size mismatch":     {SizeMismatches: []utils.SizeMismatch{{Path: "bunny/a.bun"}}},
+		"newer on remote":   {NewerOnRemote: []string{"bunny/a.bun"}},
+		"partial":           {PartialFiles: []utils.SizeMismatch{{Path: "bunny/a.bun"}}},
+	} {
+		if rep.OK() {
+			t.Errorf("report with %s is marked as ok", name)
+		}
+	}
+	if rep := (utils.DiffReport{Truncated: []string{"bunny/deep"}, MatchedCount: 1}); !rep.OK() {
+		t.Error("report with only truncated directories is not ok")
+	}
+}
+
+// resumeServer serves "bunbunbunbun" and answers range requests differently depending on the path
+func resumeServer() *httptest.Server {
+	content := []byte("bunbunbunbun")
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/range":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		case "/no-range":
+			_, _ = w.Write(content)
+		case "/wrong-range":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content)
+		case "/unsatisfiable":
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+}
+
+func TestResumeFile(t *testing.T) {
+	server := resumeServer()
+	defer server.Close()
+	client := &http.Client{Transport: &utils.LinkCheckTransport{Base: http.DefaultTransport}}
+
+	for name, test := range map[string]struct {
+		path     string
+		local    string
+		expected string
+		fails    bool
+	}{
+		"206 appends":              {path: "/range", local: "bunbun", expected: "bunbunbunbun"},
+		"200 to a range restarts":  {path: "/no-range", local: "bunbun", expected: "bunbunbunbun"},
+		"206 from the wrong start": {path: "/wrong-range", local: "bunbun", expected: "bunbun", fails: true},
+		"416":                      {path: "/unsatisfiable", local: "bunbun", expected: "bunbun", fails: true},
+		"expired link":             {path: "/expired", local: "bunbun", expected: "bunbun", fails: true},
+		"local larger than remote": {path: "/range", local: "bunbunbunbunbun", expected: "bunbunbunbunbun", fails: true},
+	} {
+		localPath := filepath.Join(t.TempDir(), "bunny.bun")
+		err := os.WriteFile(localPath, []byte(test.local), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := &utils.PFile{Name: atomic.NewString("bunny.bun"), Size: atomic.NewInt64(12), Link: atomic.NewString(server.URL + test.path)}
+		_, err = utils.ResumeFile(context.Background(), client, file, localPath)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		data, _ := os.ReadFile(localPath)
+		if string(data) != test.expected {
+			t.Errorf("%s: file is %q instead of %q", name, data, test.expected)
+		}
+	}
+}
+
+func TestRepairMismatches(t *testing.T) {
+	server := resumeServer()
+	defer server.Close()
+	client := &http.Client{Transport: &utils.LinkCheckTransport{Base: http.DefaultTransport}}
+	dir := t.TempDir()
+	for name, content := range map[string]string{"expired.bun.part": "bunbun", "stuck.bun": "bun", "oversized.bun": "bunbunbunbunbun"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote := func(link string) *utils.PFile {
+		return &utils.PFile{ID: atomic.NewString(link), Size: atomic.NewInt64(12), Link: atomic.NewString(server.URL + link)}
+	}
+	rep := utils.DiffReport{
+		SizeMismatches: []utils.SizeMismatch{
+			{Path: filepath.Join(dir, "stuck.bun"), LocalSize: 3, RemoteSize: 12, Remote: remote("/unsatisfiable")},
+			{Path: filepath.Join(dir, "oversized.bun"), LocalSize: 15, RemoteSize: 12, Remote: remote("/range")},
+		},
+		PartialFiles: []utils.SizeMismatch{
+			{Path: filepath.Join(dir, "expired.bun"), LocalSize: 6, RemoteSize: 12, Remote: remote("/expired")},
+		},
+	}
+
+	refreshed := 0
+	refresh := func(file *utils.PFile) error {
+		refreshed++
+		file.Link.Store(server.URL + "/range")
+		return nil
+	}
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	result := utils.RepairMismatches(context.Background(), &bLog, client, refresh, rep)
+	if refreshed != 1 || len(result.Resumed) != 1 || len(result.Deleted) != 1 || len(result.Untouched) != 1 {
+		t.Errorf("unexpected repair after %d refreshes: %s", refreshed, spew.Sdump(result))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "expired.bun"))
+	if err != nil || string(data) != "bunbunbunbun" {
+		t.Errorf("partial file with an expired link was not completed: %q %v", data, err)
+	}
+	_, err = os.Stat(filepath.Join(dir, "oversized.bun"))
+	if !os.IsNotExist(err) {
+		t.Error("oversized file was not deleted")
+	}
+	data, _ = os.ReadFile(filepath.Join(dir, "stuck.bun"))
+	if string(data) != "bun" {
+		t.Errorf("file that couldn't be resumed was changed: %q", data)
+	}
+}
+
+func TestPlanDownloads(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	for name, test := range map[string]struct {
+		local   string // content on disk, empty for none
+		state   string // content on disk when the state recorded it, empty for none
+		stateID string
+		skip    bool
+		stale   bool
+	}{
+		"complete":               {local: "bunbunbun", state: "bunbunbun", stateID: "bunnyID", skip: true},
+		"complete, not in state": {local: "bunbunbun", skip: true},
+		"short":                  {local: "bun"},
+		"short, in state":        {local: "bun", state: "bunbunbun", stateID: "bunnyID"},
+		"only in state":          {state: "bunbunbun", stateID: "bunnyID"},
+		"size mismatch":          {local: "bunbunbunbun"},
+		"replaced on the cloud":  {local: "bunbunbun", state: "bunbunbun", stateID: "oldID", stale: true},
+		"nothing downloaded yet": {},
+	} {
+		dir := t.TempDir()
+		job, err := app.NewSyncJob("bunny", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job.Directory = newTestDir("root", "bunny")
+		file := addTestFile(job.Directory, "bunnyID", "bunny.bun", 9, created)
+		job.Dest = utils.NewDestination(dir, false, "bunny")
+		localPath := job.Dest.Path(file)
+		job.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.MkdirAll(filepath.Dir(localPath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.state) > 0 {
+			err = os.WriteFile(localPath, []byte(test.state), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = job.State.Add(&utils.PFile{ID: atomic.NewString(test.stateID), Size: atomic.NewInt64(9), Created: atomic.NewTime(created)}, localPath, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.local != test.state {
+			// Changed or gone since the state recorded it
+			_ = os.Remove(localPath)
+			if len(test.local) > 0 {
+				err = os.WriteFile(localPath, []byte(test.local), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+		appData := &app.App{Cfg: &app.Config{}, BLog: &bLog, Stats: gokhttp_download.NewGlobalDownloadTracker(time.Second), Metrics: app.NewMetrics()}
+		appData.Stats.TotalFiles.Store(1)
+		appData.Stats.TotalBytes.Store(9)
+		err = planDownloads(appData, job)
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		if job.Skip[localPath] != test.skip || job.Stale[localPath] != test.stale {
+			t.Errorf("%s: skip %v and stale %v instead of %v and %v", name, job.Skip[localPath], job.Stale[localPath], test.skip, test.stale)
+		}
+		remaining := uint64(1)
+		if test.skip {
+			remaining = 0
+		}
+		if appData.Stats.TotalFiles.Load() != remaining || appData.Stats.TotalBytes.Load() != remaining*9 || job.Skipped.Load() != int64(1-remaining) {
+			t.Errorf("%s: totals %d files and %d bytes left after planning", name, appData.Stats.TotalFiles.Load(), appData.Stats.TotalBytes.Load())
+		}
+		if test.skip && !job.State.IsSynced(file, localPath) {
+			t.Errorf("%s: skipped file is not recorded in the state", name)
+		}
+	}
+}
+
+func TestCompareLocalToRemote(t *testing.T) {
+	now := time.Now()
+	local := newTestDir("local", "bunny")
+	addTestFile(local, "same", "same.bun", 3, now)
+	addTestFile(local, "partial", "partial.bun", 1, now)
+	addTestFile(local, "local", "local.bun", 5, now)
+	addTestFile(local, "old", "old.bun", 3, now.Add(-time.Hour))
+	remote := newTestDir("remote", "bunny")
+	addTestFile(remote, "same", "same.bun", 3, now.Add(-time.Hour))
+	addTestFile(remote, "partial", "partial.bun", 3, now.Add(-time.Hour))
+	addTestFile(remote, "old", "old.bun", 3, now)
+	remote.Directories["sub"] = newTestDir("sub", "bunny/sub")
+	addTestFile(remote.Directories["sub"], "new", "new.bun", 7, now)
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	report := utils.CompareLocalToRemote(&bLog, local, remote, "bunny")
+	if report.MatchedCount != 1 || len(report.SizeMismatches) != 1 || len(report.NewerOnRemote) != 1 || len(report.MissingInRemote) != 1 || len(report.MissingLocally) != 1 {
+		t.Errorf("unexpected report: %s", spew.Sdump(report))
+	}
+	root := report.Directories["bunny"]
+	if root == nil || root.Files[utils.DiffMissingLocally] != 1 || root.Bytes[utils.DiffMissingLocally] != 7 {
+		t.Errorf("unexpected root rollup: %s", spew.Sdump(root))
+	}
+	if sub := report.Directories[filepath.Join("bunny", "sub")]; sub == nil || sub.Files[utils.DiffMissingLocally] != 1 {
+		t.Errorf("unexpected sub rollup: %s", spew.Sdump(sub))
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	base := 5 * time.Second
+	for attempt, expected := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 3: 20 * time.Second, 20: maxRetryDelay} {
+		if delay := retryDelay(base, attempt); delay != expected {
+			t.Errorf("attempt %d: expected %s but got %s", attempt, expected, delay)
+		}
+	}
+}
+
+func TestLinkCheckTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("bunny"))
+	}))
+	defer server.Close()
+
+	hClient := &http.Client{Transport: &utils.LinkCheckTransport{Base: http.DefaultTransport}}
+	_, err := hClient.Get(server.URL + "/expired")
+	if !errors.Is(err, utils.ErrLinkExpired) {
+		t.Errorf("expected ErrLinkExpired but got: %v", err)
+	}
+	resp, err := hClient.Get(server.URL + "/bunny.bun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestSyncStateVerify(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "bunny.bun")
+	err := os.WriteFile(localPath, []byte("bunbunbun"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &utils.PFile{ID: atomic.NewString("bunnyID"), Size: atomic.NewInt64(9)}
+
+	hash, err := utils.VerifyDownload(file, localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = state.Record(file, localPath, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := state.Verify(); !report.OK() || len(report.Verified) != 1 {
+		t.Errorf("unexpected report: %s", spew.Sdump(report))
+	}
+
+	err = os.WriteFile(localPath, []byte("bunbunbum"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := state.Verify(); report.OK() || len(report.Corrupted) != 1 {
+		t.Errorf("unexpected report: %s", spew.Sdump(report))
+	}
+}
+
+func TestBuildDirectoryTreePartials(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "bunny")
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"done.bun": "bunny", utils.PartPath("busy.bun"): "bun", utils.DefaultStateName: "{}"} {
+		err = os.WriteFile(filepath.Join(root, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	local, err := utils.BuildDirectoryTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local.Files) != 1 || local.Files["done.bun"] == nil {
+		t.Errorf("unexpected files: %s", spew.Sdump(local.Files))
+	}
+	if partial := local.Partials["busy.bun"]; partial == nil || partial.Size.Load() != 3 {
+		t.Errorf("unexpected partials: %s", spew.Sdump(local.Partials))
+	}
+	if local.FileCount.Load() != 1 || local.TotalSize.Load() != 5 {
+		t.Error("partials count towards the totals")
+	}
+}
+
+func TestDestination(t *testing.T) {
+	file := &utils.PFile{Path: atomic.NewString("bunny/sub"), Name: atomic.NewString("bunny.bun")}
+
+	dest := utils.NewDestination("", false, "bunny")
+	if path := dest.Path(file); path != filepath.Join("bunny", "sub", "bunny.bun") {
+		t.Errorf("unexpected default path: %s", path)
+	}
+	dest = utils.NewDestination("/mnt/media", true, "bunny")
+	if path := dest.Path(file); path != filepath.Join("/mnt/media", "sub", "bunny.bun") {
+		t.Errorf("unexpected stripped path: %s", path)
+	}
+	if root := dest.LocalRoot(); root != "/mnt/media" {
+		t.Errorf("unexpected stripped root: %s", root)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	filter, err := utils.NewFilter([]string{"ext:mkv,.mp4", "re:^docs/.*\\.pdf$"}, []string{"**/sample/*", "*.nfo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignoreFile := filepath.Join(t.TempDir(), utils.IgnoreFileName)
+	err = os.WriteFile(ignoreFile, []byte("# comment\n/extras/\nseason*/*.mkv\n!season1/keep.mkv\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filter.LoadIgnoreFile(ignoreFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"movie.mkv":            true,
+		"show/episode.MP4":     true,
+		"show/episode.avi":     false,
+		"docs/manual.pdf":      true,
+		"show/sample/clip.mkv": false,
+		"movie.nfo":            false,
+		"extras/bonus.mkv":     false,
+		"season1/episode.mkv":  false,
+		"season1/keep.mkv":     true,
+		"other/season1/ep.mkv": true,
+	}
+	for path, expected := range cases {
+		if filter.Match(path, false) != expected {
+			t.Errorf("%s: expected %v", path, expected)
+		}
+	}
+	if filter.Match("extras", true) {
+		t.Error("ignored directory is matched")
+	}
+}
+
+func TestSelector(t *testing.T) {
+	selector, err := utils.NewSelector("50MB", "", "1d12h", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selector.NewerThan != 36*time.Hour || selector.MinSize != 50000000 {
+		t.Fatalf("unexpected selector: %+v", selector)
+	}
+
+	now := time.Now()
+	dir := newTestDir("root", "bunny")
+	if !selector.Match(addTestFile(dir, "big", "big.bun", 60000000, now.Add(-time.Hour)), now) {
+		t.Error("big and recent file is not matched")
+	}
+	if selector.Match(addTestFile(dir, "small", "small.bun", 1000, now.Add(-time.Hour)), now) {
+		t.Error("small file is matched")
+	}
+	if selector.Match(addTestFile(dir, "old", "old.bun", 60000000, now.Add(-48*time.Hour)), now) {
+		t.Error("old file is matched")
+	}
+
+	_, err = utils.NewSelector("", "", "yesterday", "")
+	if err == nil {
+		t.Error("invalid age is accepted")
+	}
+}
+
+func TestTruncatedSubtrees(t *testing.T) {
+	remote := newTestDir("root", "bunny/root")
+	remote.Truncated["deep"] = "deepID"
+	local := newTestDir("root", "bunny/root")
+	local.Directories["deep"] = newTestDir("deep", "bunny/root/deep")
+	addTestFile(local.Directories["deep"], "bunny", "bunny.bun", 3, time.Now())
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	report := utils.CompareLocalToRemote(&bLog, local, remote, "root")
+	if len(report.Truncated) != 1 || report.Truncated[0] != filepath.Join("root", "deep") {
+		t.Errorf("unexpected truncated list: %v", report.Truncated)
+	}
+	if !report.OK() || len(report.MissingInRemote) > 0 {
+		t.Errorf("files in a truncated subtree are reported as missing in remote: %v", report.MissingInRemote)
+	}
+
+	files, dirs := utils.FindMissingInRemote(local, remote, true)
+	if len(files) > 0 || len(dirs) > 0 {
+		t.Errorf("mirror would remove a truncated subtree: %v %v", files, dirs)
+	}
+}
+
+func TestCrawlDepth(t *testing.T) {
+	cloud := map[string]string{
+		"root": `[{"id":"a","name":"A","type":"folder"},{"id":"r1","name":"r1.bun","type":"file","size":3,"link":"https://bunny/r1","created_at":1700000000}]`,
+		"a":    `[{"id":"b","name":"B","type":"folder"},{"id":"a1","name":"a1.bun","type":"file","size":3,"link":"https://bunny/a1","created_at":1700000000}]`,
+		"b":    `[{"id":"b1","name":"b1.bun","type":"file","size":3,"link":"https://bunny/b1","created_at":1700000000}]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		id := r.Form.Get("id")
+		_, _ = fmt.Fprintf(w, `{"status":"success","folder_id":%q,"name":%q,"content":%s}`, id, id, cloud[id])
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	pClient := client.NewPremiumizeClient(&api.PremiumizeSession{SessionType: "apikey", AuthToken: "bunny-key"}, &http.Client{Transport: &rewriteTransport{target: target}})
+
+	flat, err := utils.CrawlFilesystem(pClient, "", "root", utils.CrawlOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flat.Directories) != 0 || len(flat.Truncated) != 0 || flat.FileCount.Load() != 1 {
+		t.Errorf("non recursive crawl reports truncated folders: %v", flat.Truncated)
+	}
+
+	limited, err := utils.CrawlFilesystem(pClient, "", "root", utils.CrawlOptions{Recursive: true, Depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := limited.Directories["A"]
+	if a == nil || len(limited.Truncated) != 0 || a.Truncated["B"] != "b" || limited.FileCount.Load() != 2 {
+		t.Errorf("depth limit didn't stop at the second level: %s", spew.Sdump(limited.Truncated, a))
+	}
+}
+
+func TestNewSyncJob(t *testing.T) {
+	cases := map[string][2]string{
+		"Movies":                  {"Movies", "/data"},
+		"Movies=/mnt/movies":      {"Movies", "/mnt/movies"},
+		"My Files/Shows=/mnt/a=b": {"My Files/Shows", "/mnt/a=b"},
+		"Shows=C:\\tv=shows":      {"Shows", "C:\\tv=shows"},
+		"Movies=":                 {"Movies", "."},
+	}
+	for spec, expected := range cases {
+		job, err := app.NewSyncJob(spec, "/data")
+		if err != nil {
+			t.Fatalf("%s: %s", spec, err)
+		}
+		if job.Folder != expected[0] || job.DestRoot != expected[1] {
+			t.Errorf("%s: got %s and %s", spec, job.Folder, job.DestRoot)
+		}
+	}
+	_, err := app.NewSyncJob("=/mnt/movies", "/data")
+	if err == nil {
+		t.Error("missing remote folder is accepted")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(location, []byte("threads: 2\nretries: 5\nretry-delay: 9\ndest: /data\nfolder: [Movies, Shows=/tv]\nprofiles:\n  nightly:\n    retries: 7\n    retry-delay:\n    dry-run: true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := app.Config{}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.IntVar(&cfg.DownloadThreads, "threads", 1, "")
+	flags.IntVar(&cfg.Retries, "retries", 3, "")
+	flags.IntVar(&cfg.RetryDelay, "retry-delay", 5, "")
+	flags.StringVar(&cfg.Dest, "dest", ".", "")
+	flags.BoolVar(&cfg.DryRun, "dry-run", false, "")
+	flags.Var(&cfg.Folders, "folder", "")
+	err = flags.Parse([]string{"-threads", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(app.EnvName("threads"), "6")
+	t.Setenv(app.EnvName("dest"), "/env")
+
+	err = app.ApplyConfig(flags, location, "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DownloadThreads != 4 {
+		t.Errorf("flag lost to env or file: %d", cfg.DownloadThreads)
+	}
+	if cfg.Dest != "/env" {
+		t.Errorf("env lost to file: %s", cfg.Dest)
+	}
+	if cfg.Retries != 7 || !cfg.DryRun {
+		t.Errorf("profile not applied: %d %v", cfg.Retries, cfg.DryRun)
+	}
+	if cfg.RetryDelay != 5 {
+		t.Errorf("empty profile setting didn't reset to the default: %d", cfg.RetryDelay)
+	}
+	if len(cfg.Folders) != 2 || cfg.Folders[1] != "Shows=/tv" {
+		t.Errorf("unexpected folders: %v", cfg.Folders)
+	}
+
+	err = app.ApplyConfig(flag.NewFlagSet("test", flag.ContinueOnError), location, "")
+	if err == nil {
+		t.Error("unknown settings are accepted")
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	previous := newTestDir("root", "root")
+	addTestFile(previous, "a", "a.bun", 1, created)
+	addTestFile(previous, "b", "b.bun", 2, created)
+	current := newTestDir("root", "root")
+	addTestFile(current, "a", "a.bun", 1, created)
+	addTestFile(current, "b", "b.bun", 3, created)
+	addTestFile(current, "c", "c.bun", 4, created)
+	changed := utils.ChangedFiles(previous, current)
+	if len(changed) != 2 || changed["root/b.bun"] == nil || changed["root/c.bun"] == nil {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+	if len(utils.ChangedFiles(nil, current)) != 3 {
+		t.Error("without a snapshot every file is new")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		wait := jitter(time.Minute, 10*time.Second)
+		if wait < 50*time.Second || wait > 70*time.Second {
+			t.Fatalf("jitter out of range: %s", wait)
+		}
+	}
+	if jitter(time.Minute, 0) != time.Minute {
+		t.Error("no spread should return the interval")
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	location := utils.LockFilePath(dir, "My Files/Movies")
+	host, _ := os.Hostname()
+	info := utils.LockInfo{PID: os.Getpid(), Host: host, Started: time.Now(), Version: "test", Folder: "My Files/Movies"}
+
+	lock, err := utils.AcquireLock(location, info, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = utils.AcquireLock(location, info, 0)
+	if !errors.Is(err, utils.ErrLocked) {
+		t.Fatalf("second lock didn't fail with ErrLocked: %v", err)
+	}
+	err = lock.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a process that crashed, nobody holds the OS lock on it anymore
+	stale := info
+	stale.PID = 1 << 30
+	data, _ := json.Marshal(stale)
+	err = os.WriteFile(location, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock, err = utils.AcquireLock(location, info, 0)
+	if err != nil {
+		t.Fatalf("stale lock wasn't recovered: %s", err)
+	}
+	_ = lock.Release()
+	if _, err = os.Stat(location); !os.IsNotExist(err) {
+		t.Error("lockfile is still there after release")
+	}
+}
+
+func TestLockStaleRace(t *testing.T) {
+	location := utils.LockFilePath(t.TempDir(), "My Files/Movies")
+	host, _ := os.Hostname()
+	for round := 0; round < 20; round++ {
+		err := os.WriteFile(location, []byte(`{"pid":1073741824,"host":"`+host+`"}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			locks []*utils.Lock
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(pid int) {
+				defer wg.Done()
+				lock, err := utils.AcquireLock(location, utils.LockInfo{PID: pid, Host: host, Started: time.Now()}, 0)
+				if err != nil {
+					if !errors.Is(err, utils.ErrLocked) {
+						t.Error(err)
+					}
+					return
+				}
+				mu.Lock()
+				locks = append(locks, lock)
+				mu.Unlock()
+			}(i + 1)
+		}
+		wg.Wait()
+		if len(locks) != 1 {
+			t.Fatalf("round %d: %d processes took over the stale lock", round, len(locks))
+		}
+		holder := utils.LockInfo{}
+		data, _ := os.ReadFile(location)
+		if json.Unmarshal(data, &holder) != nil || holder.PID != locks[0].Info.PID {
+			t.Errorf("round %d: the lockfile doesn't belong to the winner: %s", round, data)
+		}
+		err = locks[0].Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	schedule, err := utils.ParseRateSchedule("20MB/s", "09:00-18:00=5MB/s,22:00-06:00=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(hour int) int64 {
+		return schedule.LimitAt(time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local))
+	}
+	if at(10) != 5000000 {
+		t.Errorf("business hours: %d", at(10))
+	}
+	if at(20) != 20000000 {
+		t.Errorf("outside of the windows: %d", at(20))
+	}
+	if at(23) != 0 || at(2) != 0 {
+		t.Errorf("window over midnight: %d %d", at(23), at(2))
+	}
+	_, err = utils.ParseRateSchedule("", "09:00=5MB/s")
+	if err == nil {
+		t.Error("window without end is accepted")
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	body := bytes.Repeat([]byte("b"), 200*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	limiter := utils.NewRateLimiter(400 * 1024)
+	client := &http.Client{Transport: &utils.RateLimitTransport{Base: http.DefaultTransport, Limiter: limiter}}
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || n != int64(len(body)) {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	// A second of burst is free, the rest has to wait
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("took too long: %s", elapsed)
+	}
+
+	limiter.SetLimit(100 * 1024)
+	start = time.Now()
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("limit wasn't applied: %s", elapsed)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	job, err := app.NewSyncJob("Movies=/data", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appData := &app.App{
+		Cfg:     &app.Config{},
+		BLog:    &bLog,
+		Stats:   gokhttp_download.NewGlobalDownloadTracker(time.Second),
+		Limiter: utils.NewRateLimiter(0),
+		Control: app.NewControl(2),
+		Jobs:    []*app.SyncJob{job},
+	}
+	appData.Shutdown = app.NewShutdown(&bLog)
+	defer appData.Shutdown.Close()
+	server := httptest.NewServer(appData.Handler())
+	defer server.Close()
+
+	call := func(method, path string, result interface{}) int {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if result != nil {
+			err = json.NewDecoder(resp.Body).Decode(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	status := app.Status{}
+	call(http.MethodGet, "/status", &status)
+	if status.Threads != 2 || status.Paused || len(status.Jobs) != 1 || status.Jobs[0].Folder != "Movies" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	call(http.MethodPost, "/threads?n=20", nil)
+	call(http.MethodPost, "/pause", nil)
+	if appData.Control.Threads() != app.MaxThreads || !appData.Control.Paused() {
+		t.Error("threads or pause not applied")
+	}
+	call(http.MethodPost, "/resume", nil)
+	if appData.Control.Paused() {
+		t.Error("resume not applied")
+	}
+
+	if call(http.MethodPost, "/cancel", nil) != http.StatusBadRequest {
+		t.Error("cancel without path is accepted")
+	}
+	call(http.MethodPost, "/cancel?path=/data/Movies/bunny.bun", nil)
+	ctx, done := appData.Control.Start(context.Background(), "/data/Movies/bunny.bun")
+	defer done()
+	if ctx.Err() == nil {
+		t.Error("cancelled file can still start")
+	}
+	appData.Control.NextPass()
+	if appData.Control.Cancelled("/data/Movies/bunny.bun") {
+		t.Error("cancelled file is still skipped in the next pass")
+	}
+
+	if call(http.MethodGet, "/pause", nil) != http.StatusMethodNotAllowed {
+		t.Error("control endpoints must be POST")
+	}
+	call(http.MethodPost, "/stop", nil)
+	if appData.Shutdown.Stopping.Err() == nil {
+		t.Error("stop not applied")
+	}
+	if appData.Stats.GraceFulStop.Load() {
+		t.Error("stop closes the running downloads")
+	}
+}
+
+// TestAPIDuringPass reads the API while a watch pass replaces the tree and resets the job, run it with -race
+func TestAPIDuringPass(t *testing.T) {
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	job, err := app.NewSyncJob("Movies=/data", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appData := &app.App{
+		Cfg:     &app.Config{},
+		BLog:    &bLog,
+		Stats:   gokhttp_download.NewGlobalDownloadTracker(time.Second),
+		Limiter: utils.NewRateLimiter(0),
+		Control: app.NewControl(2),
+		Jobs:    []*app.SyncJob{job},
+	}
+	appData.Shutdown = app.NewShutdown(&bLog)
+	defer appData.Shutdown.Close()
+	server := httptest.NewServer(appData.Handler())
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			job.SetDirectory(newTestDir("root", "Movies"))
+			job.Failures.Add(&app.Failure{Path: "/data/Movies/bunny.bun"})
+			job.NextPass()
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, path := range []string{"/status", "/tree"} {
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	}
+	if len(job.Failures.List()) != 0 {
+		t.Errorf("NextPass didn't reset the failures: %d", len(job.Failures.List()))
+	}
+}
+
+// TestEndPass makes sure the next watch pass downloads what the last one didn't get to, even when a crawl fails in between
+func TestEndPass(t *testing.T) {
+	dir := t.TempDir()
+	job, err := app.NewSyncJob("bunny", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Dest = utils.NewDestination(dir, false, "bunny")
+	job.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := newTestDir("root", "bunny")
+	files := map[string]*utils.PFile{}
+	for _, id := range []string{"complete", "downloaded", "failed", "not started"} {
+		files[id] = addTestFile(tree, id, id+".bun", 3, time.Unix(1700000000, 0))
+	}
+	err = os.MkdirAll(job.Dest.LocalRoot(), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(job.Dest.Path(files["complete"]), []byte("bun"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{Cfg: &app.Config{}, BLog: &bLog, Stats: gokhttp_download.NewGlobalDownloadTracker(time.Second), Metrics: app.NewMetrics()}
+	plan := func() {
+		appData.Stats.TotalFiles.Store(4)
+		appData.Stats.TotalBytes.Store(12)
+		err := planDownloads(appData, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	job.SetDirectory(tree)
+	plan()
+	// The pass ends early, before "not started" was sent to a worker
+	job.Verified.Add(files["downloaded"], job.Dest.Path(files["downloaded"]))
+	job.Failures.Add(&app.Failure{ID: "failed", Path: job.Dest.Path(files["failed"])})
+	job.EndPass()
+
+	// The crawl of the next pass fails, the one after that finds nothing new
+	job.NextPass()
+	job.NextPass()
+	job.SetDirectory(tree)
+	plan()
+	for id, skip := range map[string]bool{"complete": true, "downloaded": true, "failed": false, "not started": false} {
+		if job.Skip[job.Dest.Path(files[id])] != skip {
+			t.Errorf("%s: skip %v in the next pass", id, !skip)
+		}
+	}
+}
+
+// TestCancelledNextPass cancels a file through the API, the next watch pass has to plan it again instead of skipping it as unchanged
+func TestCancelledNextPass(t *testing.T) {
+	dir := t.TempDir()
+	job, err := app.NewSyncJob("bunny", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Dest = utils.NewDestination(dir, false, "bunny")
+	job.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := newTestDir("root", "bunny")
+	file := addTestFile(tree, "bunnyID", "bunny.bun", 9, time.Unix(1700000000, 0))
+	localPath := job.Dest.Path(file)
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{Cfg: &app.Config{}, BLog: &bLog, Stats: gokhttp_download.NewGlobalDownloadTracker(time.Second), Control: app.NewControl(1), Metrics: app.NewMetrics()}
+	plan := func() {
+		appData.Stats.TotalFiles.Store(1)
+		appData.Stats.TotalBytes.Store(9)
+		err := planDownloads(appData, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	job.SetDirectory(tree)
+	plan()
+	appData.Control.Cancel(localPath)
+	downloadLoop(context.Background(), appData, job, nil, make(chan *Job))
+	if job.Cancelled.Load() != 1 {
+		t.Fatalf("file wasn't cancelled")
+	}
+	job.EndPass()
+
+	appData.Control.NextPass()
+	job.NextPass()
+	job.SetDirectory(tree)
+	plan()
+	if job.Skip[localPath] || appData.Control.Cancelled(localPath) {
+		t.Errorf("cancelled file isn't planned in the next pass: skip %v, cancelled %v", job.Skip[localPath], appData.Control.Cancelled(localPath))
+	}
+}
+
+// TestDownloadLoopStops makes sure the download loop doesn't hang on a queue that no worker reads anymore
+func TestDownloadLoopStops(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("bunbunbun"))
+	}))
+	defer server.Close()
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{
+		Cfg:            &app.Config{},
+		BLog:           &bLog,
+		Stats:          gokhttp_download.NewGlobalDownloadTracker(time.Second),
+		DownloadClient: server.Client(),
+		Control:        app.NewControl(2),
+		Metrics:        app.NewMetrics(),
+	}
+	job, err := app.NewSyncJob("bunny", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Dest = utils.NewDestination(job.DestRoot, false, "bunny")
+	dir := newTestDir("root", "bunny")
+	for _, name := range []string{"a.bun", "b.bun"} {
+		addTestFile(dir, name, name, 9, time.Now()).Link.Store(server.URL + "/" + name)
+	}
+	appData.Stats.TotalFiles.Add(2)
+	appData.Stats.TotalBytes.Add(18)
+	appData.Metrics.QueueDepth.Store(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		downloadLoop(ctx, appData, job, dir, make(chan *Job))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("download loop is still blocked on the queue")
+	}
+	if appData.Stats.Tasks.Len() != 0 || appData.Metrics.QueueDepth.Load() != 1 {
+		t.Errorf("dropped task is still accounted for: %d tasks, queue depth %d", appData.Stats.Tasks.Len(), appData.Metrics.QueueDepth.Load())
+	}
+}
+
+// TestWorkerRetries runs downloads against a server that fails the first requests, the tracker totals have to add up afterwards
+func TestWorkerRetries(t *testing.T) {
+	for name, test := range map[string]struct {
+		failures int
+		retries  int
+		attempts int
+		failed   bool
+	}{
+		"no failures":        {failures: 0, retries: 2, attempts: 1},
+		"recovers":           {failures: 2, retries: 2, attempts: 3},
+		"runs out of tries":  {failures: 5, retries: 2, attempts: 3, failed: true},
+		"retries turned off": {failures: 1, retries: 0, attempts: 1, failed: true},
+	} {
+		var requests atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests.Inc() <= int64(test.failures) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte("bunbunbun"))
+		}))
+
+		bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+		appData := &app.App{
+			Cfg:            &app.Config{Retries: test.retries},
+			BLog:           &bLog,
+			Stats:          gokhttp_download.NewGlobalDownloadTracker(time.Second),
+			DownloadClient: &http.Client{Transport: &utils.LinkCheckTransport{Base: http.DefaultTransport}},
+			Control:        app.NewControl(1),
+			Metrics:        app.NewMetrics(),
+		}
+		appData.Shutdown = app.NewShutdown(&bLog)
+		dir := t.TempDir()
+		sync, err := app.NewSyncJob("bunny", dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sync.Dest = utils.NewDestination(dir, false, "bunny")
+		sync.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := addTestFile(newTestDir("root", "bunny"), "bunnyID", "bunny.bun", 9, time.Unix(1700000000, 0))
+		file.Link.Store(server.URL + "/bunny.bun")
+		// As counted by the crawl
+		appData.Stats.TotalFiles.Store(1)
+		appData.Stats.TotalBytes.Store(9)
+
+		task, err := newTask(appData, sync, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := &Job{Sync: sync, File: file, Task: task}
+		downloadJob(context.Background(), 1, job, appData)
+		server.Close()
+		appData.Shutdown.Close()
+
+		retries := uint64(test.attempts - 1)
+		if job.Attempts != test.attempts || appData.Metrics.Retries.Load() != retries {
+			t.Errorf("%s: %d attempts and %d retries instead of %d and %d", name, job.Attempts, appData.Metrics.Retries.Load(), test.attempts, retries)
+		}
+		// A failed file leaves the totals, a completed one is in both the totals and the downloaded counts
+		expectedFiles, expectedBytes := uint64(1), uint64(9)
+		if test.failed {
+			expectedFiles, expectedBytes = 0, 0
+		}
+		failures := sync.Failures.List()
+		if test.failed != (len(failures) == 1) || sync.Downloaded.Load() != int64(expectedFiles) {
+			t.Errorf("%s: %d failures and %d downloaded", name, len(failures), sync.Downloaded.Load())
+		}
+		if test.failed && (failures[0].Attempts != test.attempts || appData.Metrics.FilesFailed.Load() != 1) {
+			t.Errorf("%s: failure recorded with %d attempts", name, failures[0].Attempts)
+		}
+		if test.failed == sync.State.IsDownloaded(file, sync.Dest.Path(file)) {
+			t.Errorf("%s: state doesn't match the download", name)
+		}
+		stats := appData.Stats
+		if stats.TotalFiles.Load() != expectedFiles || stats.TotalBytes.Load() != expectedBytes || stats.DownloadedFiles.Load() != expectedFiles || stats.DownloadedBytes.Load() != expectedBytes {
+			t.Errorf("%s: totals %d files %d bytes, downloaded %d files %d bytes", name, stats.TotalFiles.Load(), stats.TotalBytes.Load(), stats.DownloadedFiles.Load(), stats.DownloadedBytes.Load())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/folder/list" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("bunny"))
+	}))
+	defer backend.Close()
+
+	appData := &app.App{Metrics: app.NewMetrics(), Control: app.NewControl(3), Limiter: utils.NewRateLimiter(0)}
+	client := &http.Client{Transport: &utils.ObserveTransport{
+		Base:    &utils.RateLimitTransport{Base: http.DefaultTransport, Limiter: appData.Limiter, Bytes: appData.Metrics.DownloadedBytes},
+		Observe: appData.Metrics.ObserveAPI,
+	}}
+	for _, path := range []string{"/api/folder/list", "/file"} {
+		resp, err := client.Get(backend.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+	appData.Metrics.ObserveCrawl(`My "Movies"`, 1500*time.Millisecond)
+	appData.Metrics.Retries.Inc()
+
+	server := httptest.NewServer(appData.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	for _, line := range []string{
+		"pfs_downloaded_bytes_total 5",
+		"pfs_retries_total 1",
+		"pfs_threads 3",
+		`pfs_crawl_duration_seconds{folder="My \"Movies\""} 1.5`,
+		`pfs_api_requests_total{endpoint="/api/folder/list"} 1`,
+		`pfs_api_errors_total{endpoint="/api/folder/list"} 1`,
+		`pfs_api_errors_total{endpoint="/file"} 0`,
+		`pfs_api_request_duration_seconds_count{endpoint="/file"} 1`,
+		"# TYPE pfs_api_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+// TestEvents locks the -daemon event schema, a change here breaks the scripts that parse it and needs a new app.EventVersion
+func TestEvents(t *testing.T) {
+	out := &bytes.Buffer{}
+	events := app.NewEvents(out)
+	events.Now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60)) }
+	job := "Movies -> /data"
+	expected := []struct {
+		kind string
+		data interface{}
+		line string
+	}{
+		{app.EventCrawlStarted, &app.CrawlStartedEvent{Folder: "Movies"},
+			`{"v":1,"type":"crawl_started","time":"2024-05-01T10:00:00Z","data":{"folder":"Movies"}}`},
+		{app.EventCrawlFinished, &app.CrawlFinishedEvent{Folder: "Movies", Files: 2, Bytes: 2048, Duration: 1.5},
+			`{"v":1,"type":"crawl_finished","time":"2024-05-01T10:00:00Z","data":{"folder":"Movies","files":2,"bytes":2048,"duration":1.5}}`},
+		{app.EventFileQueued, &app.FileEvent{Job: job, Path: "/data/Movies/bunny.bun", Size: 1024},
+			`{"v":1,"type":"file_queued","time":"2024-05-01T10:00:00Z","data":{"job":"Movies -> /data","path":"/data/Movies/bunny.bun","size":1024,"attempts":0}}`},
+		{app.EventFileProgress, &app.FileProgressEvent{Path: "/data/Movies/bunny.bun", Size: 1024, Downloaded: 512, Speed: 256},
+			`{"v":1,"type":"file_progress","time":"2024-05-01T10:00:00Z","data":{"path":"/data/Movies/bunny.bun","size":1024,"downloaded":512,"speed":256}}`},
+		{app.EventFileDone, &app.FileEvent{Job: job, Path: "/data/Movies/bunny.bun", Size: 1024, Attempts: 2},
+			`{"v":1,"type":"file_done","time":"2024-05-01T10:00:00Z","data":{"job":"Movies -> /data","path":"/data/Movies/bunny.bun","size":1024,"attempts":2}}`},
+		{app.EventFileFailed, &app.FileFailedEvent{Job: job, Path: "/data/Movies/carrot.bun", Attempts: 3, Error: "status code 500"},
+			`{"v":1,"type":"file_failed","time":"2024-05-01T10:00:00Z","data":{"job":"Movies -> /data","path":"/data/Movies/carrot.bun","attempts":3,"error":"status code 500"}}`},
+		{app.EventSyncFinished, &app.SyncFinishedEvent{Stopped: false, Jobs: []app.JobStatus{{
+			Name: job, Folder: "Movies", Dest: "/data", Downloaded: 1, DownloadedBytes: 1024, Skipped: 4, Cancelled: 0,
+			Failures: []*app.Failure{{ID: "abc", Path: "/data/Movies/carrot.bun", Attempts: 3, Error: "status code 500"}},
+		}}},
+			`{"v":1,"type":"sync_finished","time":"2024-05-01T10:00:00Z","data":{"stopped":false,"jobs":[{"name":"Movies -> /data","folder":"Movies","dest":"/data","downloaded":1,"downloadedBytes":1024,"skipped":4,"cancelled":0,"moved":0,"failures":[{"id":"abc","path":"/data/Movies/carrot.bun","attempts":3,"error":"status code 500"}]}]}}`},
+	}
+	for _, event := range expected {
+		events.Emit(event.kind, event.data)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %d:\n%s", len(expected), len(lines), out.String())
+	}
+	for i, event := range expected {
+		if lines[i] != event.line {
+			t.Errorf("%s changed:\n got: %s\nwant: %s", event.kind, lines[i], event.line)
+		}
+	}
+
+	// Without -daemon there is no writer
+	var disabled *app.Events
+	disabled.Emit(app.EventCrawlStarted, &app.CrawlStartedEvent{Folder: "Movies"})
+}
+
+// TestDaemonStdout runs the verify and mirror paths that print messages and errors, with -daemon nothing but events may reach stdout
+func TestDaemonStdout(t *testing.T) {
+	dir := t.TempDir()
+	job, err := app.NewSyncJob("bunny", filepath.Join(dir, "gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Directory = newTestDir("root", "bunny")
+	file := addTestFile(job.Directory, "bunnyID", "bunny.bun", 3, time.Now())
+	job.Dest = utils.NewDestination(dir, false, "bunny")
+	job.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(job.Dest.LocalRoot(), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(job.Dest.Path(file), []byte("bun"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = job.State.Add(file, job.Dest.Path(file), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(job.Dest.Path(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{Cfg: &app.Config{Daemon: true}, BLog: &bLog}
+	// Prints the missing file and the summary
+	verify(appData, job)
+	// Fails to read the local folder, it doesn't exist
+	mirror(appData, job)
+	os.Stdout = stdout
+	_ = writer.Close()
+	data, _ := io.ReadAll(reader)
+	if len(data) > 0 {
+		t.Errorf("printed to stdout with -daemon: %q", data)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	for command, expected := range map[string][]string{
+		`notify {path}`:                       {"notify", "{path}"},
+		`  curl -d "a b" 'c "d"'  `:           {"curl", "-d", "a b", `c "d"`},
+		`echo "say \"hi\"" one\ arg`:          {"echo", `say "hi"`, "one arg"},
+		`C:\tools\notify.exe --file={path}`:   {`C:\tools\notify.exe`, "--file={path}"},
+		`sh -c 'echo "$0" >> log.txt' {path}`: {"sh", "-c", `echo "$0" >> log.txt`, "{path}"},
+	} {
+		args, err := utils.SplitCommand(command)
+		if err != nil {
+			t.Errorf("%s: %s", command, err.Error())
+			continue
+		}
+		if fmt.Sprint(args) != fmt.Sprint(expected) || len(args) != len(expected) {
+			t.Errorf("%s: expected %q, got %q", command, expected, args)
+		}
+	}
+	for _, command := range []string{`echo "open`, `echo 'open`} {
+		_, err := utils.SplitCommand(command)
+		if err == nil {
+			t.Errorf("%s: no error for an unterminated quote", command)
+		}
+	}
+
+	// A value with spaces and quotes stays a single argument
+	args := utils.ExpandCommand([]string{"notify", "--file={path}"}, map[string]string{"path": `/data/it's "here".mkv; rm -rf /`})
+	if len(args) != 2 || args[1] != `--file=/data/it's "here".mkv; rm -rf /` {
+		t.Errorf("unexpected expansion: %q", args)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	dir := t.TempDir()
+	fileLog, syncLog := filepath.Join(dir, "files.txt"), filepath.Join(dir, "sync.json")
+
+	posts := make(chan []byte, 3)
+	failFirst := atomic.NewBool(true)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failFirst.Swap(false) {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		posts <- body
+	}))
+	defer webhook.Close()
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	hooks, err := app.NewHooks(&app.Config{
+		OnFileDone:  fmt.Sprintf(`sh -c 'printf "%%s|%%s\n" "$0" "$1" >> "$2"' {path} {size} %q`, fileLog),
+		OnSyncDone:  fmt.Sprintf(`sh -c 'cat > "$0"; echo "$1" > "$0.status"' %q {status}`, syncLog),
+		Webhook:     webhook.URL,
+		HookTimeout: 10 * time.Second,
+	}, &bLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := app.NewSyncJob("Movies="+dir, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &utils.PFile{Name: atomic.NewString("bunny.bun"), Size: atomic.NewInt64(42)}
+	hooks.OnFileDone(context.Background(), job, file, `/data/it's a "bunny".bun`)
+	hooks.Wait()
+	logged, err := os.ReadFile(fileLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(logged) != "/data/it's a \"bunny\".bun|42\n" {
+		t.Errorf("unexpected file hook output: %q", logged)
+	}
+
+	summary := &app.SyncFinishedEvent{Jobs: []app.JobStatus{{Name: job.Name(), Failures: []*app.Failure{{Path: "/data/carrot.bun", Error: "status code 500"}}}}}
+	hooks.OnSyncDone(context.Background(), app.SyncStatusFailed, summary)
+	stdin, err := os.ReadFile(syncLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := os.ReadFile(syncLog + ".status")
+	if string(status) != "failed\n" {
+		t.Errorf("unexpected status: %q", status)
+	}
+	select {
+	case body := <-posts:
+		if string(body) != string(stdin) {
+			t.Errorf("the webhook and the command got different summaries:\n%s\n%s", body, stdin)
+		}
+		event := struct {
+			Type string                `json:"type"`
+			Data app.SyncFinishedEvent `json:"data"`
+		}{}
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != app.EventSyncFinished || len(event.Data.Jobs) != 1 || len(event.Data.Jobs[0].Failures) != 1 {
+			t.Errorf("unexpected webhook payload: %s", body)
+		}
+	default:
+		t.Error("the webhook wasn't retried")
+	}
+
+	// Nothing configured or no hooks at all
+	var none *app.Hooks
+	none.OnFileDone(context.Background(), job, file, "/data/bunny.bun")
+	none.OnSyncDone(context.Background(), app.SyncStatusOK, summary)
+	none.Wait()
+}
+
+// rewriteTransport sends every request to the test server, whatever host it was meant for
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMoveRemote(t *testing.T) {
+	type item struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+	newCloud := func() map[string][]item {
+		return map[string][]item{
+			"root": {{"a", "A", "folder"}, {"b", "B", "folder"}, {"c", "C", "folder"}},
+			"a":    {{"a1", "a1.bun", "file"}, {"a2", "a2.bun", "file"}},
+			"b":    {{"b1", "b1.bun", "file"}, {"b2", "excluded.nfo", "file"}},
+			"c":    {{"c1", "c1.bun", "file"}, {"d", "D", "folder"}},
+			"d":    {{"d1", "d1.bun", "file"}},
+		}
+	}
+	var (
+		mu    sync.Mutex
+		cloud map[string][]item
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = r.ParseForm()
+		if r.Form.Get("apikey") != "bunny-key" {
+			_, _ = w.Write([]byte(`{"status":"error","message":"not logged in"}`))
+			return
+		}
+		id := r.Form.Get("id")
+		switch r.URL.Path {
+		case "/api/folder/list":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "folder_id": id, "content": cloud[id]})
+			return
+		case "/api/item/delete", "/api/folder/delete":
+			for parent, items := range cloud {
+				for i, it := range items {
+					if it.ID == id {
+						cloud[parent] = append(items[:i:i], items[i+1:]...)
+						delete(cloud, id)
+						_, _ = w.Write([]byte(`{"status":"success"}`))
+						return
+					}
+				}
+			}
+		}
+		_, _ = w.Write([]byte(`{"status":"error","message":"not found"}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	pClient := client.NewPremiumizeClient(&api.PremiumizeSession{SessionType: "apikey", AuthToken: "bunny-key"}, &http.Client{Transport: &rewriteTransport{target: target}})
+
+	// Our tree as crawled, the filter left excluded.nfo out
+	root, a, b, c, d := newTestDir("root", "Movies"), newTestDir("a", "Movies/A"), newTestDir("b", "Movies/B"), newTestDir("c", "Movies/C"), newTestDir("d", "Movies/C/D")
+	root.Directories["A"], root.Directories["B"], root.Directories["C"], c.Directories["D"] = a, b, c, d
+	created := time.Unix(1700000000, 0)
+	addTestFile(a, "a1", "a1.bun", 3, created)
+	addTestFile(a, "a2", "a2.bun", 3, created)
+	addTestFile(b, "b1", "b1.bun", 3, created)
+	addTestFile(c, "c1", "c1.bun", 3, created)
+	addTestFile(d, "d1", "d1.bun", 3, created)
+	// a2 failed to download
+	verified := map[string]bool{"a1": true, "b1": true, "c1": true, "d1": true}
+
+	expectedFiles := []string{"Movies/A/a1.bun", "Movies/B/b1.bun", "Movies/C/c1.bun", "Movies/C/D/d1.bun"}
+	expectedDirs := []string{"Movies/C/D", "Movies/C"}
+	for _, dryRun := range []bool{true, false} {
+		cloud = newCloud()
+		report := utils.MoveRemote(context.Background(), pClient, root, verified, dryRun)
+		if len(report.Errors) > 0 {
+			t.Fatalf("dry run %t: %v", dryRun, report.Errors)
+		}
+		if fmt.Sprint(report.Files) != fmt.Sprint(expectedFiles) || fmt.Sprint(report.Directories) != fmt.Sprint(expectedDirs) {
+			t.Errorf("dry run %t: unexpected report %v %v", dryRun, report.Files, report.Directories)
+		}
+		remaining := fmt.Sprint(cloud)
+		if dryRun && remaining != fmt.Sprint(newCloud()) {
+			t.Errorf("dry run deleted something: %s", remaining)
+		}
+		if !dryRun && remaining != "map[a:[{a2 a2.bun file}] b:[{b2 excluded.nfo file}] root:[{a A folder} {b B folder}]]" {
+			t.Errorf("unexpected cloud after the move: %s", remaining)
+		}
+	}
+
+	// Errors are reported and keep the folder
+	cloud = newCloud()
+	badClient := client.NewPremiumizeClient(&api.PremiumizeSession{SessionType: "apikey", AuthToken: "carrot"}, pClient.Client)
+	report := utils.MoveRemote(context.Background(), badClient, root, verified, false)
+	if len(report.Errors) != 4 || len(report.Files) > 0 || len(report.Directories) > 0 || !strings.Contains(report.Errors[0], "not logged in") {
+		t.Errorf("unexpected report with a bad key: %+v", report)
+	}
+}
+
+// TestMove checks which files -move picks, the ones verified by this pass and by an earlier run
+func TestMove(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		deleted []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = r.ParseForm()
+		deleted = append(deleted, r.Form.Get("id"))
+		_, _ = w.Write([]byte(`{"status":"success"}`))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	pClient := client.NewPremiumizeClient(&api.PremiumizeSession{SessionType: "apikey", AuthToken: "bunny-key"}, &http.Client{Transport: &rewriteTransport{target: target}})
+
+	dir := t.TempDir()
+	job, err := app.NewSyncJob("bunny", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.Dest = utils.NewDestination(dir, false, "bunny")
+	job.Directory = newTestDir("root", "bunny")
+	job.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(job.Dest.LocalRoot(), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*utils.PFile{}
+	for _, id := range []string{"downloaded", "earlier", "unhashed", "hashed", "changed", "missing"} {
+		file := addTestFile(job.Directory, id, id+".bun", 3, time.Unix(1700000000, 0))
+		files[id] = file
+		if id == "missing" {
+			continue
+		}
+		err = os.WriteFile(job.Dest.Path(file), []byte("bun"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	job.Verified.Add(files["downloaded"], job.Dest.Path(files["downloaded"]))
+	for _, id := range []string{"earlier", "changed"} {
+		err = job.State.RecordDownload(files[id], job.Dest.Path(files[id]), "bunhash")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Recorded like planDownloads and -rebuildstate do, then hashed by -verify without us ever downloading it
+	err = job.State.Add(files["hashed"], job.Dest.Path(files["hashed"]), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := job.State.Verify(); len(report.Hashed) != 1 {
+		t.Fatalf("verify hashed %v", report.Hashed)
+	}
+	err = job.State.Add(files["unhashed"], job.Dest.Path(files["unhashed"]), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(job.Dest.Path(files["changed"]), []byte("carrot"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{Cfg: &app.Config{Move: true, Daemon: true}, Client: pClient, BLog: &bLog, Metrics: app.NewMetrics()}
+	appData.Shutdown = app.NewShutdown(&bLog)
+	defer appData.Shutdown.Close()
+	move(appData, job)
+	sort.Strings(deleted)
+	if fmt.Sprint(deleted) != "[downloaded earlier]" || job.Moved.Load() != 2 {
+		t.Errorf("unexpected files moved: %v", deleted)
+	}
+}
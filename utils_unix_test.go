@@ -0,0 +1,131 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/app"
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+	"github.com/BRUHItsABunny/bunnlog"
+	gokhttp_download "github.com/BRUHItsABunny/gOkHttp-download"
+)
+
+// TestShutdown sends a real signal to the test process, Windows has no way to do that
+func TestShutdown(t *testing.T) {
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	shutdown := app.NewShutdown(&bLog)
+	order := []int{}
+	shutdown.OnExit(func() { order = append(order, 1) })
+	shutdown.OnExit(func() { order = append(order, 2) })
+
+	err := syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-shutdown.Stopping.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("first signal didn't stop")
+	}
+	if shutdown.Aborted.Err() != nil {
+		t.Error("first signal aborted")
+	}
+
+	shutdown.Close()
+	shutdown.Close()
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("cleanups didn't run once in reverse order: %v", order)
+	}
+	shutdown.Abort()
+	if shutdown.Aborted.Err() == nil {
+		t.Error("abort didn't cancel")
+	}
+}
+
+// TestShutdownFinishesDownload sends the first signal while a slow download is running, the download has to complete instead of failing
+func TestShutdownFinishesDownload(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "9")
+		_, _ = w.Write([]byte("bun"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("bunbun"))
+	}))
+	defer server.Close()
+
+	bLog := bunnlog.GetBunnLog(false, bunnlog.VerbosityWARNING, 0)
+	appData := &app.App{
+		Cfg:            &app.Config{Retries: 2},
+		BLog:           &bLog,
+		Stats:          gokhttp_download.NewGlobalDownloadTracker(time.Minute),
+		DownloadClient: &http.Client{Transport: &utils.LinkCheckTransport{Base: http.DefaultTransport}},
+		Control:        app.NewControl(1),
+		Metrics:        app.NewMetrics(),
+	}
+	appData.Shutdown = app.NewShutdown(&bLog)
+	defer appData.Shutdown.Close()
+	dir := t.TempDir()
+	sync, err := app.NewSyncJob("bunny", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync.Dest = utils.NewDestination(dir, false, "bunny")
+	sync.State, err = utils.LoadState(filepath.Join(dir, utils.DefaultStateName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := addTestFile(newTestDir("root", "bunny"), "bunnyID", "bunny.bun", 9, time.Unix(1700000000, 0))
+	file.Link.Store(server.URL + "/bunny.bun")
+	appData.Stats.TotalFiles.Store(1)
+	appData.Stats.TotalBytes.Store(9)
+	task, err := newTask(appData, sync, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workChan := make(chan *Job, 1)
+	workerDone := make(chan struct{})
+	go func() {
+		_ = Worker(context.Background(), 1, workChan, appData)
+		close(workerDone)
+	}()
+	workChan <- &Job{Sync: sync, File: file, Task: task}
+	<-started
+	err = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-appData.Shutdown.Stopping.Done()
+	// Longer than the tracker takes to notice a graceful stop
+	time.Sleep(1500 * time.Millisecond)
+	if appData.Stats.GraceFulStop.Load() {
+		t.Error("first signal set the graceful stop while a download was running")
+	}
+	// Like syncJobs does once the loop stopped enqueueing
+	close(workChan)
+	close(release)
+	select {
+	case <-workerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker didn't stop after the download")
+	}
+
+	if sync.Downloaded.Load() != 1 || len(sync.Failures.List()) != 0 {
+		t.Errorf("%d downloaded and %d failures after the first signal", sync.Downloaded.Load(), len(sync.Failures.List()))
+	}
+	data, err := os.ReadFile(sync.Dest.Path(file))
+	if err != nil || string(data) != "bunbunbun" {
+		t.Errorf("download didn't complete: %q %v", data, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/app"
+)
+
+const healthInterval = 10 * time.Second
+
+// watch keeps syncing the already crawled jobs, crawling them again after every interval until SIGINT or SIGTERM.
+// A signal stops the current pass like the idle timeout does, so downloads that are running get to finish.
+func watch(appData *app.App) {
+	ctx := appData.Shutdown.Stopping
+
+	health := app.NewHealth(appData.Cfg.HealthPath)
+	done := make(chan struct{})
+	defer close(done)
+	go health.Beat(healthInterval, done)
+
+	for pass := 1; ctx.Err() == nil; pass++ {
+		if pass > 1 {
+			appData.ResetStats()
+			appData.Control.NextPass()
+			for _, job := range appData.Jobs {
+				job.NextPass()
+			}
+			err := crawlJobs(appData)
+			if err != nil {
+				// Keep watching, the cloud might be back by the next pass
+				appData.BLog.Errorf("Watch: failed to crawl: %s", err.Error())
+				_ = health.Update(func(h *app.Health) {
+					h.LastError = err.Error()
+				})
+				if !waitForPass(ctx, appData, health) {
+					break
+				}
+				continue
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		_ = health.Update(func(h *app.Health) {
+			h.Status = app.HealthSyncing
+			h.Pass = pass
+			h.PassStarted = time.Now()
+		})
+		ok, err := syncJobs(appData)
+		failures := 0
+		for _, job := range appData.Jobs {
+			failures += len(job.Failures.List())
+			job.EndPass()
+		}
+		_ = health.Update(func(h *app.Health) {
+			h.PassFinished = time.Now()
+			h.Failures = failures
+			h.LastError = ""
+			if err != nil {
+				h.LastError = err.Error()
+			} else if ok {
+				h.LastSuccess = h.PassFinished
+			}
+		})
+		if err != nil {
+			appData.BLog.Errorf("Watch: pass %d failed: %s", pass, err.Error())
+		}
+		if !waitForPass(ctx, appData, health) {
+			break
+		}
+	}
+	_ = health.Update(func(h *app.Health) {
+		h.Status = app.HealthStopping
+	})
+}
+
+// waitForPass sleeps until the next pass, returns false if we got a signal in the meantime
+func waitForPass(ctx context.Context, appData *app.App, health *app.Health) bool {
+	wait := jitter(appData.Cfg.Watch, appData.Cfg.WatchJitter)
+	next := time.Now().Add(wait)
+	_ = health.Update(func(h *app.Health) {
+		h.Status = app.HealthWaiting
+		h.NextPass = next
+	})
+	msg := fmt.Sprintf("Watch: next crawl at %s", next.Format(time.RFC3339))
+	if !appData.Cfg.Daemon {
+		fmt.Println(msg)
+	}
+	appData.BLog.Info(msg)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// jitter randomly moves the interval by up to spread in either direction, so many watchers don't crawl at the same time
+func jitter(interval, spread time.Duration) time.Duration {
+	if spread <= 0 {
+		return interval
+	}
+	result := interval + time.Duration(rand.Int63n(int64(2*spread)+1)) - spread
+	if result < 0 {
+		result = 0
+	}
+	return result
+}
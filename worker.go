@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/app"
+	"github.com/BRUHItsABunny/Premiumize-File-Sync/utils"
+	"github.com/BRUHItsABunny/gOkHttp-download"
+)
+
+const (
+	maxRetryDelay    = 5 * time.Minute
+	maxLinkRefreshes = 3
+)
+
+// Job pairs a download task with the remote file and the sync job it was created for
+type Job struct {
+	Sync          *app.SyncJob
+	File          *utils.PFile
+	Task          *gokhttp_download.ThreadedDownloadTask
+	Attempts      int
+	LinkRefreshes int
+}
+
+func Worker(ctx context.Context, threadId int, workChan chan *Job, appData *app.App) error {
+	appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker starting", threadId))
+	ticker := time.NewTicker(time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			break
+		case job, ok := <-workChan:
+			if !ok {
+				// Closed after the first signal once nothing is enqueued anymore
+				appData.BLog.Info(fmt.Sprintf("[thread:%d] Worker stopping - Graceful stop", threadId))
+				return nil
+			} else if job == nil {
+				continue
+			} else if appData.Shutdown.Stopping.Err() != nil {
+				// Queued but not started, the part file is kept for the next run
+				appData.Metrics.QueueDepth.Dec()
+				discardTask(appData, job.Task)
+			} else {
+				// Blocking, failures are retried and recorded, they never stop the other workers
+				appData.Metrics.QueueDepth.Dec()
+				appData.Metrics.ActiveWorkers.Inc()
+				downloadJob(ctx, threadId, job, appData)
+				appData.Metrics.ActiveWorkers.Dec()
+			}
+			break
+		case <-ctx.Done():
+			break
+		}
+		if ctx.Err() != nil {
+			appData.BLog.Info(fmt.Sprintf("[thread:%d] Worker stopping - Aborted", threadId))
+			break
+		}
+		if appData.Stats.GraceFulStop.Load() {
+			appData.BLog.Info(fmt.Sprintf("[thread:%d] Worker stopping - Graceful stop", threadId))
+			break
+		}
+	}
+	appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker stopping", threadId))
+	return nil
+}
+
+func downloadJob(ctx context.Context, threadId int, job *Job, appData *app.App) {
+	localPath := job.Sync.Dest.Path(job.File)
+	ctx, done := appData.Control.Start(ctx, localPath)
+	defer done()
+	for {
+		job.Attempts++
+		appData.BLog.Debug(fmt.Sprintf("[thread:%d] Worker downloading: %s (attempt %d)", threadId, job.Task.FileLocation.Load(), job.Attempts))
+		err := job.Task.Download(ctx)
+		if err == nil {
+			err = finishJob(appData, job)
+			if err == nil {
+				return
+			}
+			// Doesn't count as downloaded and can't be trusted to resume from
+			appData.Stats.DownloadedFiles.Dec()
+			_ = os.Remove(job.Task.FileLocation.Load())
+		}
+
+		appData.BLog.Error(fmt.Sprintf("[thread:%d] Download failed: %s", threadId, err.Error()))
+		appData.BLog.Debug(fmt.Sprintf("[thread:%d] Task: %s", threadId, TaskJSON(job.Task)))
+		discardTask(appData, job.Task)
+		if appData.Control.Cancelled(localPath) {
+			appData.BLog.Info(fmt.Sprintf("[thread:%d] Cancelled %s", threadId, job.File.Name.Load()))
+			cancelJob(appData, job)
+			return
+		}
+		if errors.Is(err, utils.ErrLinkExpired) && job.LinkRefreshes < maxLinkRefreshes {
+			// Not the file's fault, get a fresh link and try again without it counting as an attempt
+			job.LinkRefreshes++
+			job.Attempts--
+			appData.Metrics.LinkRefreshes.Inc()
+			appData.BLog.Info(fmt.Sprintf("[thread:%d] Refreshing expired link of %s", threadId, job.File.Name.Load()))
+			err = utils.RefreshLink(appData.Client, job.File)
+			if err == nil {
+				job.Task, err = newTask(appData, job.Sync, job.File)
+			}
+			if err != nil {
+				job.Attempts++
+				failJob(appData, job, err)
+				return
+			}
+			continue
+		}
+		if job.Attempts > appData.Cfg.Retries || ctx.Err() != nil || appData.Shutdown.Stopping.Err() != nil || appData.Stats.GraceFulStop.Load() {
+			failJob(appData, job, err)
+			return
+		}
+
+		appData.Metrics.Retries.Inc()
+		delay := retryDelay(time.Duration(appData.Cfg.RetryDelay)*time.Second, job.Attempts)
+		appData.BLog.Info(fmt.Sprintf("[thread:%d] Retrying %s in %s", threadId, job.File.Name.Load(), delay))
+		if !waitForRetry(ctx, appData, delay) {
+			failJob(appData, job, err)
+			return
+		}
+
+		job.Task, err = newTask(appData, job.Sync, job.File)
+		if err != nil {
+			failJob(appData, job, err)
+			return
+		}
+	}
+}
+
+// finishJob verifies the downloaded part file and moves it into place, only then the file is recorded as synced
+func finishJob(appData *app.App, job *Job) error {
+	partPath := job.Task.FileLocation.Load()
+	hash, err := utils.VerifyDownload(job.File, partPath)
+	if err != nil {
+		return fmt.Errorf("utils.VerifyDownload: %w", err)
+	}
+	finalPath := job.Sync.Dest.Path(job.File)
+	err = os.Rename(partPath, finalPath)
+	if err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	job.Sync.Downloaded.Inc()
+	job.Sync.Verified.Add(job.File, finalPath)
+	appData.Metrics.FilesCompleted.Inc()
+	appData.Events.Emit(app.EventFileDone, &app.FileEvent{Job: job.Sync.Name(), Path: finalPath, Size: job.File.Size.Load(), Attempts: job.Attempts})
+	job.Sync.DownloadedBytes.Add(job.File.Size.Load())
+	err = job.Sync.State.RecordDownload(job.File, finalPath, hash)
+	if err != nil {
+		appData.BLog.Warn(fmt.Sprintf("Failed to record sync state: %s", err.Error()))
+	}
+	appData.Hooks.OnFileDone(appData.Shutdown.Aborted, job.Sync, job.File, finalPath)
+	return nil
+}
+
+// newTask creates the download task for a file, the totals already contain the file since the crawl so the task's own contribution is taken back out.
+// The task writes into a part file next to the final location, so an interrupted download never looks like a complete file.
+func newTask(appData *app.App, sync *app.SyncJob, file *utils.PFile) (*gokhttp_download.ThreadedDownloadTask, error) {
+	partPath := utils.PartPath(sync.Dest.Path(file))
+	task, err := gokhttp_download.NewThreadedDownloadTask(context.Background(), appData.DownloadClient, appData.Stats, partPath, file.Link.Load(), 1, uint64(file.Size.Load())) //requests.NewHeaderOption(http.Header{"Accept-Encoding": []string{"identity"}})
+	if errors.Is(err, utils.ErrLinkExpired) {
+		// Resuming checks the link before downloading anything
+		err = utils.RefreshLink(appData.Client, file)
+		if err != nil {
+			return nil, fmt.Errorf("utils.RefreshLink: %w", err)
+		}
+		appData.Metrics.LinkRefreshes.Inc()
+		task, err = gokhttp_download.NewThreadedDownloadTask(context.Background(), appData.DownloadClient, appData.Stats, partPath, file.Link.Load(), 1, uint64(file.Size.Load()))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("download.NewThreadedDownloadTask: %w", err)
+	}
+	appData.Stats.TotalFiles.Dec()
+	appData.Stats.TotalBytes.Sub(task.TaskStats.FileSize.Load())
+	return task, nil
+}
+
+// discardTask undoes what a failed task left behind, the bytes it had on disk are counted again by the next task for the same file
+func discardTask(appData *app.App, task *gokhttp_download.ThreadedDownloadTask) {
+	_ = task.TaskStats.F.Close()
+	appData.Stats.Tasks.Del(task.FileLocation.Load())
+	appData.Stats.DownloadedBytes.Sub(task.TaskStats.DownloadedBytes.Load())
+}
+
+func failJob(appData *app.App, job *Job, err error) {
+	// The file won't be downloaded during this run, take it out of the totals
+	appData.Stats.TotalFiles.Dec()
+	appData.Stats.TotalBytes.Sub(uint64(job.File.Size.Load()))
+	appData.Metrics.FilesFailed.Inc()
+	appData.Events.Emit(app.EventFileFailed, &app.FileFailedEvent{Job: job.Sync.Name(), Path: job.Sync.Dest.Path(job.File), Attempts: job.Attempts, Error: err.Error()})
+	job.Sync.Failures.Add(&app.Failure{
+		ID:       job.File.ID.Load(),
+		Path:     job.Sync.Dest.Path(job.File),
+		Attempts: job.Attempts,
+		Error:    err.Error(),
+	})
+}
+
+// cancelJob takes a file that was cancelled through the API out of the totals, it is not a failure and the part file is kept.
+// In watch mode the file is still pending after the pass, so the next pass tries it again.
+func cancelJob(appData *app.App, job *Job) {
+	appData.Stats.TotalFiles.Dec()
+	appData.Stats.TotalBytes.Sub(uint64(job.File.Size.Load()))
+	job.Sync.Cancelled.Inc()
+	appData.Metrics.FilesCancelled.Inc()
+}
+
+// retryDelay doubles the base delay for every attempt
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	delay := time.Duration(float64(base) * math.Pow(2, float64(attempt-1)))
+	if delay > maxRetryDelay || delay < 0 {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// waitForRetry sleeps for the delay, returns false if we are stopping in the meantime
+func waitForRetry(ctx context.Context, appData *app.App, delay time.Duration) bool {
+	deadline := time.Now().Add(delay)
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil || appData.Shutdown.Stopping.Err() != nil || appData.Stats.GraceFulStop.Load() {
+			return false
+		}
+		// Waiting is not idling, don't let the UI time us out
+		appData.Stats.IdleSince.Store(time.Time{})
+		time.Sleep(time.Second)
+	}
+	return true
+}
+
+func TaskJSON(task *gokhttp_download.ThreadedDownloadTask) string {
+	jsonBytes, err := json.Marshal(task)
+	if err != nil {
+		return ""
+	}
+
+	return string(jsonBytes)
+}